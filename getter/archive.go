@@ -0,0 +1,395 @@
+package getter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// archiveFormat allows us to have a type safe value naming how an archive is laid out
+type archiveFormat string
+
+const (
+	tarArchive archiveFormat = "tar"
+	zipArchive archiveFormat = "zip"
+)
+
+// archiveMemberSeparator separates an archive from the member within it, as in bundle.tar.gz#path/in/archive
+const archiveMemberSeparator = "#"
+
+// zipReadAhead is the least a range request reading a remote zip directory asks for, so that walking the
+// directory takes a handful of requests rather than one per entry
+const zipReadAhead = 64 * 1024
+
+// archiveExtensions are the extensions of archives whose members can be fetched, along with how the archive
+// is compressed. Longer extensions come first so .tar.gz is not taken for .gz.
+var archiveExtensions = []struct {
+	ext      string
+	format   archiveFormat
+	encoding Encoding
+}{
+	{ext: ".tar.gz", format: tarArchive, encoding: EncodingGzip},
+	{ext: ".tgz", format: tarArchive, encoding: EncodingGzip},
+	{ext: ".tar.bz2", format: tarArchive, encoding: EncodingBzip2},
+	{ext: ".tbz2", format: tarArchive, encoding: EncodingBzip2},
+	{ext: ".tar", format: tarArchive, encoding: EncodingIdentity},
+	{ext: ".zip", format: zipArchive, encoding: EncodingIdentity},
+}
+
+// archiveFormatOf returns how the archive called name is laid out and compressed, ok is false for names
+// that are not archives
+func archiveFormatOf(name string) (format archiveFormat, encoding Encoding, ok bool) {
+	lower := strings.ToLower(name)
+	for _, a := range archiveExtensions {
+		if strings.HasSuffix(lower, a.ext) {
+			return a.format, a.encoding, true
+		}
+	}
+	return "", "", false
+}
+
+// splitArchiveMember splits location into an archive and the member within it, ok is false when location
+// does not name a member of an archive
+func splitArchiveMember(location string) (archive, member string, ok bool) {
+	for i := 0; i < len(location); i++ {
+		j := strings.Index(location[i:], archiveMemberSeparator)
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		if _, _, isArchive := archiveFormatOf(location[:i]); isArchive {
+			member = cleanMemberName(location[i+len(archiveMemberSeparator):])
+			return location[:i], member, member != ""
+		}
+	}
+	return "", "", false
+}
+
+// cleanMemberName normalises the name of an archive member so it can be compared with the names in the archive
+func cleanMemberName(name string) string {
+	name = strings.TrimLeft(name, "/")
+	if name == "" {
+		return ""
+	}
+	return strings.TrimPrefix(path.Clean(name), "./")
+}
+
+// archiveMember returns the request for the archive the named backend would fetch for req, along with the
+// member to pull out of it. ok is false when the location the backend uses is not an archive member. The
+// remote backend looks at the key, the local one at the local path and the http one at the URL's fragment.
+// Other backends look at the key, then the local path.
+func archiveMember(name string, req FetchRequest) (archiveReq FetchRequest, member string, ok bool) {
+	archiveReq = req
+	switch name {
+	case string(Remote):
+		archiveReq.Key, member, ok = splitArchiveMember(req.Key)
+	case string(Local):
+		archiveReq.LocalPath, member, ok = splitArchiveMember(req.LocalPath)
+	case string(HTTP):
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Fragment == "" {
+			return req, "", false
+		}
+		if _, _, isArchive := archiveFormatOf(u.Path); !isArchive {
+			return req, "", false
+		}
+		member = cleanMemberName(u.Fragment)
+		u.Fragment = ""
+		archiveReq.URL, ok = u.String(), member != ""
+	default:
+		if archiveReq.Key, member, ok = splitArchiveMember(req.Key); !ok {
+			archiveReq.Key = req.Key
+			archiveReq.LocalPath, member, ok = splitArchiveMember(req.LocalPath)
+		}
+	}
+	if !ok {
+		return req, "", false
+	}
+	return archiveReq, member, true
+}
+
+// namesArchiveMember reports whether any location of r names a member of an archive
+func (r FetchRequest) namesArchiveMember() bool {
+	for _, name := range []string{string(Remote), string(Local), string(HTTP)} {
+		if _, _, ok := archiveMember(name, r); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchMember fetches member out of the archive archiveReq names from the named backend. Tar archives are
+// read up to the member, zip archives that are not local are read with range requests.
+func (g *Getter) fetchMember(ctx context.Context, name string, archiveReq FetchRequest, member string) (*FetchResult, error) {
+	archiveReq.Range, archiveReq.Checksum = nil, nil
+	format, encoding, _ := archiveFormatOf(archiveName(name, archiveReq))
+	if format == zipArchive && name != string(Local) {
+		// only the size of the archive is needed up front, the rest is read with ranges
+		archiveInfo, host, err := g.statFromBackend(ctx, name, archiveReq)
+		if err != nil {
+			return nil, err
+		}
+		body, info, err := g.rangedZipMember(ctx, name, archiveReq, archiveInfo.Size, member)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read member %q of archive", member)
+		}
+		return &FetchResult{Body: body, Source: Source(name), Host: host, ObjectInfo: info}, nil
+	}
+
+	res, err := g.fetchFromBackend(ctx, name, archiveReq)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	var info ObjectInfo
+	if format == zipArchive {
+		body, info, err = g.zipMember(ctx, name, archiveReq, res, member)
+	} else {
+		body, info, err = tarMember(res.Body, encoding, member)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read member %q of archive", member)
+	}
+	return &FetchResult{Body: body, Source: res.Source, Host: res.Host, ObjectInfo: info}, nil
+}
+
+// archiveName returns the name of the archive archiveReq asks the named backend for
+func archiveName(name string, archiveReq FetchRequest) string {
+	switch {
+	case name == string(Local):
+		return archiveReq.LocalPath
+	case name == string(HTTP):
+		if u, err := url.Parse(archiveReq.URL); err == nil {
+			return u.Path
+		}
+		return ""
+	case archiveReq.Key != "":
+		return archiveReq.Key
+	}
+	return archiveReq.LocalPath
+}
+
+// tarMember reads the tar archive in body up to member, returning a reader of the member that closes body
+func tarMember(body io.ReadCloser, encoding Encoding, member string) (io.ReadCloser, ObjectInfo, error) {
+	decoded, err := newDecoder(encoding, body)
+	if err != nil {
+		body.Close()
+		return nil, ObjectInfo{}, err
+	}
+	var archive io.ReadCloser = body
+	if decoded != nil {
+		archive = &decodedReader{ReadCloser: decoded, body: body}
+	}
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			archive.Close()
+			return nil, ObjectInfo{}, errors.Wrap(ErrNotFound, "no such member")
+		}
+		if err != nil {
+			archive.Close()
+			return nil, ObjectInfo{}, err
+		}
+		if cleanMemberName(hdr.Name) != member {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			archive.Close()
+			return nil, ObjectInfo{}, errors.New("member is not a regular file")
+		}
+		info := ObjectInfo{Size: hdr.Size, LastModified: hdr.ModTime}
+		return readCloser{Reader: tr, Closer: archive}, info, nil
+	}
+}
+
+// zipMember finds member in the directory of the local zip archive res holds, reading it in place when the
+// local backend allows it and with range requests otherwise
+func (g *Getter) zipMember(ctx context.Context, name string, archiveReq FetchRequest, res *FetchResult, member string) (io.ReadCloser, ObjectInfo, error) {
+	size := res.Size
+	if ra, ok := res.Body.(io.ReaderAt); ok {
+		f, err := findZipMember(ra, size, member)
+		if err != nil {
+			res.Body.Close()
+			return nil, ObjectInfo{}, err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			res.Body.Close()
+			return nil, ObjectInfo{}, err
+		}
+		return &decodedReader{ReadCloser: rc, body: res.Body}, zipMemberInfo(f), nil
+	}
+
+	// only the size of the archive was needed, the rest is read with ranges
+	res.Body.Close()
+	return g.rangedZipMember(ctx, name, archiveReq, size, member)
+}
+
+// rangedZipMember finds member in the directory of the zip archive of size bytes with range requests to the
+// named backend, fetching the member's data in a single request
+func (g *Getter) rangedZipMember(ctx context.Context, name string, archiveReq FetchRequest, size int64, member string) (io.ReadCloser, ObjectInfo, error) {
+	if size < 0 {
+		return nil, ObjectInfo{}, errors.New("the size of the archive is unknown")
+	}
+	ra := &rangeReaderAt{ctx: ctx, g: g, name: name, req: archiveReq, size: size}
+	f, err := findZipMember(ra, size, member)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	body, err := ra.memberData(f)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return body, zipMemberInfo(f), nil
+}
+
+// findZipMember looks member up in the directory of the zip archive in r
+func findZipMember(r io.ReaderAt, size int64, member string) (*zip.File, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if cleanMemberName(f.Name) != member {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			return nil, errors.New("member is a directory")
+		}
+		return f, nil
+	}
+	return nil, errors.Wrap(ErrNotFound, "no such member")
+}
+
+// zipMemberInfo describes the content of a zip member
+func zipMemberInfo(f *zip.File) ObjectInfo {
+	return ObjectInfo{Size: int64(f.UncompressedSize64), LastModified: f.Modified}
+}
+
+// rangeReaderAt reads an archive with range requests to a single backend, reading ahead so that small
+// reads of a zip directory share a request
+type rangeReaderAt struct {
+	ctx  context.Context
+	g    *Getter
+	name string
+	req  FetchRequest
+	size int64
+
+	// buf holds the bytes of the archive starting at bufOffset from the last request
+	buf       []byte
+	bufOffset int64
+}
+
+// ReadAt reads len(p) bytes of the archive at off, from the last request when it covers them
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if off < r.bufOffset || off+int64(len(p)) > r.bufOffset+int64(len(r.buf)) {
+		length := int64(len(p))
+		if length < zipReadAhead {
+			length = zipReadAhead
+		}
+		if off+length > r.size {
+			length = r.size - off
+		}
+		buf, err := r.read(off, length)
+		if err != nil {
+			return 0, err
+		}
+		r.buf, r.bufOffset = buf, off
+	}
+
+	n := copy(p, r.buf[off-r.bufOffset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// read fetches length bytes of the archive at off
+func (r *rangeReaderAt) read(off, length int64) ([]byte, error) {
+	body, err := r.open(off, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// open starts a range request for length bytes of the archive at off
+func (r *rangeReaderAt) open(off, length int64) (io.ReadCloser, error) {
+	req := r.req
+	req.Range = &ByteRange{Offset: off, Length: length}
+	res, err := r.g.fetchFromBackend(r.ctx, r.name, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// memberData fetches the data of a zip member in one range request, decompressing it and checking its CRC
+func (r *rangeReaderAt) memberData(f *zip.File) (io.ReadCloser, error) {
+	var decompress func(io.Reader) io.ReadCloser
+	switch f.Method {
+	case zip.Store:
+		decompress = ioutil.NopCloser
+	case zip.Deflate:
+		decompress = flate.NewReader
+	default:
+		return nil, errors.Errorf("unsupported compression method %d", f.Method)
+	}
+
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser = ioutil.NopCloser(strings.NewReader(""))
+	if f.CompressedSize64 > 0 {
+		// a zero length range would read to the end of the archive
+		if body, err = r.open(offset, int64(f.CompressedSize64)); err != nil {
+			return nil, err
+		}
+	}
+	checked := &zipChecker{Reader: decompress(body), hash: crc32.NewIEEE(), crc: f.CRC32, remaining: int64(f.UncompressedSize64)}
+	return readCloser{Reader: checked, Closer: body}, nil
+}
+
+// zipChecker checks the size and CRC of a zip member at the end of its content
+type zipChecker struct {
+	io.Reader
+	hash      hash.Hash32
+	crc       uint32
+	remaining int64
+}
+
+// Read reads the member, reporting zip.ErrChecksum or zip.ErrFormat at the end of content that does not match
+func (z *zipChecker) Read(p []byte) (int, error) {
+	n, err := z.Reader.Read(p)
+	z.hash.Write(p[:n])
+	z.remaining -= int64(n)
+	if z.remaining < 0 {
+		return n, zip.ErrFormat
+	}
+	if err == io.EOF {
+		if z.remaining != 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		if z.crc != 0 && z.hash.Sum32() != z.crc {
+			return n, zip.ErrChecksum
+		}
+	}
+	return n, err
+}
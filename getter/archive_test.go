@@ -0,0 +1,227 @@
+package getter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archiveMembers are the files put in the archives of the tests, noise is large enough that a zip holding it
+// is worth reading in part
+var archiveMembers = map[string][]byte{
+	"day/a.eml": []byte("Subject: a\r\n\r\nbody a"),
+	"day/b.eml": []byte("Subject: b\r\n\r\nbody b"),
+	"noise.bin": noise(256 * 1024),
+}
+
+// noise returns n bytes that do not compress
+func noise(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// newTarGz returns a gzipped tar of archiveMembers, with a directory entry and names prefixed by ./
+func newTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./day/", Typeflag: tar.TypeDir, Mode: 0755}))
+	for _, name := range []string{"day/a.eml", "day/b.eml", "noise.bin"} {
+		data := archiveMembers[name]
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: fakeS3ModTime}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// newZip returns a zip of archiveMembers, the mail deflated and the noise stored
+func newZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	_, err := zw.Create("day/")
+	require.NoError(t, err)
+	for _, name := range []string{"noise.bin", "day/a.eml", "day/b.eml"} {
+		method := zip.Deflate
+		if name == "noise.bin" {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: fakeS3ModTime})
+		require.NoError(t, err)
+		_, err = w.Write(archiveMembers[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// TestFetchArchiveMember verifies that members of local, remote and http archives are fetched on their own
+func TestFetchArchiveMember(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tgz, zipped := newTarGz(t), newZip(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bundle.tar.gz"), tgz, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bundle.zip"), zipped, 0600))
+
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "bundle.tar.gz", tgz)
+	s3.Put("bucket", "bundle.zip", zipped)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", fakeS3ModTime, bytes.NewReader(tgz))
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		name           string
+		req            FetchRequest
+		expectedData   []byte
+		expectedSource Source
+		expectedKind   error
+		expectedErr    string
+	}{
+		{name: "local tar", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.tar.gz#day/b.eml")}, expectedData: archiveMembers["day/b.eml"], expectedSource: Local},
+		{name: "local zip", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.zip#day/a.eml")}, expectedData: archiveMembers["day/a.eml"], expectedSource: Local},
+		{name: "local zip stored", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.zip#/noise.bin")}, expectedData: archiveMembers["noise.bin"], expectedSource: Local},
+		{name: "remote tar", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "bundle.tar.gz#./day/a.eml"}, expectedData: archiveMembers["day/a.eml"], expectedSource: Remote},
+		{name: "remote zip", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "bundle.zip#day/b.eml"}, expectedData: archiveMembers["day/b.eml"], expectedSource: Remote},
+		{name: "http tar", req: FetchRequest{URL: srv.URL + "/bundle.tar.gz#day/b.eml"}, expectedData: archiveMembers["day/b.eml"], expectedSource: HTTP},
+		{name: "remote member falls back to local file", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "bundle.zip#day/missing.eml", LocalPath: filepath.Join(dir, "bundle.tar.gz#day/a.eml")}, expectedData: archiveMembers["day/a.eml"], expectedSource: Local},
+		{name: "missing member", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.tar.gz#day/missing.eml")}, expectedSource: Local, expectedKind: ErrNotFound},
+		{name: "missing zip member", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "bundle.zip#missing.eml"}, expectedSource: Remote, expectedKind: ErrNotFound},
+		{name: "directory", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.zip#day")}, expectedSource: Local, expectedErr: "member is a directory"},
+		{name: "tar directory", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.tar.gz#day/")}, expectedSource: Local, expectedErr: "not a regular file"},
+		{name: "range", req: FetchRequest{LocalPath: filepath.Join(dir, "bundle.zip#day/a.eml"), Range: &ByteRange{Offset: 1}}, expectedKind: ErrInvalidRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret")
+			res, err := fetcher.FetchObject(context.Background(), test.req)
+			if test.expectedData == nil {
+				require.Error(t, err)
+				if test.expectedKind != nil {
+					assert.True(t, errors.Is(err, test.expectedKind), "%v", err)
+				}
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, body)
+			assert.Equal(t, test.expectedSource, res.Source)
+			assert.Equal(t, int64(len(test.expectedData)), res.Size)
+			assert.True(t, fakeS3ModTime.Equal(res.LastModified.UTC().Truncate(time.Second)), "%v", res.LastModified)
+		})
+	}
+}
+
+// TestFetchRemoteZipMemberRanges verifies that members of remote zip archives are read with range requests
+// rather than a download of the whole archive
+func TestFetchRemoteZipMemberRanges(t *testing.T) {
+	zipped := newZip(t)
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "bundle.zip", zipped)
+
+	fetcher := New(discardLogger(), true, "key", "secret")
+	fh, _, err := fetcher.FetchFile("", s3.Host(), "bucket", "bundle.zip#day/b.eml")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(fh)
+	require.NoError(t, err)
+	require.NoError(t, fh.Close())
+	assert.Equal(t, archiveMembers["day/b.eml"], body)
+
+	s3.mu.Lock()
+	defer s3.mu.Unlock()
+	ranged := 0
+	for _, r := range s3.ranges {
+		if r != "" {
+			ranged++
+		}
+	}
+	assert.Equal(t, atomic.LoadInt64(&s3.getRequests), int64(ranged), "every GET is a range request: %v", s3.ranges)
+	assert.True(t, ranged <= 3, "the directory and member take a few requests: %v", s3.ranges)
+}
+
+// TestFetchHTTPZipMemberRanges verifies that the size of a zip archive behind a URL comes from a HEAD request,
+// so the whole archive is never downloaded
+func TestFetchHTTPZipMemberRanges(t *testing.T) {
+	zipped := newZip(t)
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", fakeS3ModTime, bytes.NewReader(zipped))
+	}))
+	defer srv.Close()
+
+	fetcher := New(discardLogger(), true, "key", "secret")
+	res, err := fetcher.FetchObject(context.Background(), FetchRequest{URL: srv.URL + "/bundle.zip#day/b.eml"})
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, archiveMembers["day/b.eml"], body)
+	assert.Equal(t, HTTP, res.Source)
+	assert.Equal(t, strings.TrimPrefix(srv.URL, "http://"), res.Host)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, requests)
+	assert.Equal(t, "HEAD ", requests[0])
+	for _, r := range requests[1:] {
+		assert.True(t, strings.HasPrefix(r, "GET bytes="), "every GET is a range request: %v", requests)
+	}
+	assert.True(t, len(requests) <= 4, "the size, directory and member take a few requests: %v", requests)
+}
+
+// TestSplitArchiveMember verifies which locations name a member of an archive
+func TestSplitArchiveMember(t *testing.T) {
+	for _, test := range []struct {
+		location        string
+		expectedArchive string
+		expectedMember  string
+		expectedOK      bool
+	}{
+		{location: "bundle.tar.gz#path/in/archive", expectedArchive: "bundle.tar.gz", expectedMember: "path/in/archive", expectedOK: true},
+		{location: "/var/mail/BUNDLE.ZIP#./x.eml", expectedArchive: "/var/mail/BUNDLE.ZIP", expectedMember: "x.eml", expectedOK: true},
+		{location: "dir#1/bundle.tgz#x#y.eml", expectedArchive: "dir#1/bundle.tgz", expectedMember: "x#y.eml", expectedOK: true},
+		{location: "bundle.tar#", expectedOK: false},
+		{location: "mail.eml#part", expectedOK: false},
+		{location: "bundle.zip", expectedOK: false},
+	} {
+		t.Run(test.location, func(t *testing.T) {
+			archive, member, ok := splitArchiveMember(test.location)
+			assert.Equal(t, test.expectedOK, ok)
+			if ok {
+				assert.Equal(t, test.expectedArchive, archive)
+				assert.Equal(t, test.expectedMember, member)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Backend is a storage system files can be fetched from. The remote and local file systems and HTTP URLs are the
+// built in backends, others can be added with RegisterBackend and used with WithBackends.
+type Backend interface {
+	// Name identifies the backend, and is the Source of the files it serves
+	Name() string
+	// Fetch returns the file described by req, limited to req.Range when one is set, along with its info
+	Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error)
+	// Stat returns the info of the whole file described by req without reading it
+	Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Backend{}
+)
+
+// RegisterBackend makes b available to WithBackends under its name.
+// It panics if the name is empty, is one of the built in backends, or has already been registered.
+func RegisterBackend(b Backend) {
+	name := b.Name()
+	if name == "" || isBuiltinBackend(name) {
+		panic("getter: cannot register a backend named " + name)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("getter: backend " + name + " is already registered")
+	}
+	registry[name] = b
+}
+
+// Backends returns the names of the built in and registered backends, sorted
+func Backends() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := []string{string(HTTP), string(Local), string(Remote)}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupBackend returns the registered backend called name
+func lookupBackend(name string) (Backend, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	b, ok := registry[name]
+	return b, ok
+}
+
+// isBuiltinBackend reports whether name is one of the backends every Getter has
+func isBuiltinBackend(name string) bool {
+	return name == string(Remote) || name == string(Local) || name == string(HTTP)
+}
+
+// WithBackends fetches files from the named backends, trying each in turn until one serves the file, instead of
+// the backends the Getter's Strategy picks. "remote", "local" and "http" are the built in backends, others must be
+// registered with RegisterBackend. The remote backend is skipped for requests without a complete remote location,
+// the local one for requests without a local path and the http one for requests without a URL. Other backends are
+// handed every request.
+func WithBackends(names ...string) Option {
+	return func(g *Getter) {
+		g.backendChain = append([]string{}, names...)
+	}
+}
+
+// chain returns the names of the backends fetches try, in order
+func (g *Getter) chain() []string {
+	if g.backendChain != nil {
+		return g.backendChain
+	}
+	return g.strategy.chain()
+}
+
+// checkSources reports an error if req.Sources names a backend the Getter does not use. Sources only
+// reorder what the Strategy, or WithBackends, allows.
+func (g *Getter) checkSources(req FetchRequest) error {
+	allowed := g.chain()
+	for _, s := range req.Sources {
+		if !containsName(allowed, string(s)) {
+			return errors.Errorf("source %q is not one of the sources the getter uses: %s", s, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// containsName reports whether names holds name
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchChain tries each of the named backends in turn, returning the first file served.
+// If every backend fails the last error is returned.
+func (g *Getter) fetchChain(ctx context.Context, req FetchRequest, names []string) (*FetchResult, error) {
+	var lastErr error
+	var lastSource Source
+	skippedRemote, skippedURL := false, false
+	for _, name := range names {
+		if name == string(Remote) && !g.hasRemote(req) {
+			skippedRemote = true
+			continue
+		}
+		if name == string(Local) && req.LocalPath == "" {
+			continue
+		}
+		if name == string(HTTP) && (req.URL == "" || validateURL(req.URL) != nil) {
+			skippedURL = req.URL != ""
+			continue
+		}
+
+		switch {
+		case lastErr != nil:
+			g.logger.Printf("falling back to %s source - %v", name, lastErr)
+		case skippedRemote && req.remoteErr() != nil:
+			g.logger.Printf("falling back to %s source - invalid remote location - %v", name, req.remoteErr())
+		case skippedRemote:
+			// we want to do remote fs stuff, but host, bucket, or key are messed up
+			g.logger.Printf(`falling back to %s source - missing fields. "host":%q, "bucket":%q, "key":%q`, name, req.Host, req.Bucket, req.Key)
+		case skippedURL:
+			g.logger.Printf("falling back to %s source - invalid url - %v", name, validateURL(req.URL))
+		}
+		skippedRemote, skippedURL = false, false
+
+		res, err := g.fetchBackend(ctx, name, req)
+		if err == nil {
+			return res, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// the caller gave up, the other backends are not wanted either
+			return &FetchResult{Source: Source(name)}, ctxErr
+		}
+		lastErr, lastSource = err, Source(name)
+	}
+
+	if lastErr == nil {
+		return &FetchResult{}, invalidRequestError(req, errors.Errorf("none of the backends %s can serve the request", strings.Join(names, ", ")))
+	}
+	return &FetchResult{Source: lastSource}, newFetchError(lastSource, req, lastErr)
+}
+
+// fetchBackend fetches req from the named backend, pulling the file out of an archive when the location the
+// backend uses names an archive member, see archiveMember.
+func (g *Getter) fetchBackend(ctx context.Context, name string, req FetchRequest) (*FetchResult, error) {
+	if archiveReq, member, ok := archiveMember(name, req); ok {
+		return g.fetchMember(ctx, name, archiveReq, member)
+	}
+	return g.fetchFromBackend(ctx, name, req)
+}
+
+// fetchFromBackend fetches req from the named backend. The remote backend goes through the endpoints of req's
+// bucket, the disk cache, retries and circuit breakers. The http backend retries and uses the circuit breaker
+// of the URL's host.
+func (g *Getter) fetchFromBackend(ctx context.Context, name string, req FetchRequest) (*FetchResult, error) {
+	var b Backend
+	switch name {
+	case string(Remote):
+		return g.fetchRemoteEndpoints(ctx, req)
+	case string(Local):
+		b = g.local
+	case string(HTTP):
+		return g.fetchHTTP(ctx, req)
+	default:
+		var ok bool
+		if b, ok = lookupBackend(name); !ok {
+			return nil, errors.Errorf("unknown backend %q", name)
+		}
+	}
+
+	fh, info, err := b.Fetch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchResult{Body: fh, Source: Source(name), ObjectInfo: info}, nil
+}
+
+// statFromBackend looks up what the named backend knows about req without fetching it, along with the remote
+// host that answered
+func (g *Getter) statFromBackend(ctx context.Context, name string, req FetchRequest) (ObjectInfo, string, error) {
+	var b Backend
+	switch name {
+	case string(Remote):
+		return g.statRemoteEndpoints(ctx, req)
+	case string(Local):
+		b = g.local
+	case string(HTTP):
+		info, err := g.statHTTP(ctx, req)
+		return info, urlHost(req.URL), err
+	default:
+		var ok bool
+		if b, ok = lookupBackend(name); !ok {
+			return ObjectInfo{}, "", errors.Errorf("unknown backend %q", name)
+		}
+	}
+
+	info, err := b.Stat(ctx, req)
+	return info, "", err
+}
@@ -0,0 +1,139 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// namedBackend is a Backend serving data under any name, or failing with err
+type namedBackend struct {
+	name    string
+	data    []byte
+	err     error
+	fetched int
+}
+
+func (b *namedBackend) Name() string {
+	return b.name
+}
+
+func (b *namedBackend) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	b.fetched++
+	if b.err != nil {
+		return nil, ObjectInfo{}, b.err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.data)), ObjectInfo{Size: int64(len(b.data))}, nil
+}
+
+func (b *namedBackend) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(b.data))}, b.err
+}
+
+// registerTestBackend registers b unless a backend of the same name already is, so tests can be run repeatedly
+func registerTestBackend(b Backend) {
+	if _, ok := lookupBackend(b.Name()); !ok {
+		RegisterBackend(b)
+	}
+}
+
+// TestFetchBackendChain verifies that backends are tried in the order of the chain, the one serving the file
+// being its Source
+func TestFetchBackendChain(t *testing.T) {
+	working := &namedBackend{name: "test-chain-working", data: []byte("test-chain-working data")}
+	broken := &namedBackend{name: "test-chain-broken", err: errNoSuchKey}
+	registerTestBackend(working)
+	registerTestBackend(broken)
+	req := FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"}
+
+	tests := []struct {
+		name           string
+		chain          []string
+		req            FetchRequest
+		expectedSource Source
+		expectedErr    Source
+		invalid        bool
+		expectedLog    string
+	}{
+		{name: "registered backend", chain: []string{"test-chain-working", "local"}, req: req, expectedSource: "test-chain-working"},
+		{name: "fall back to built in", chain: []string{"test-chain-broken", "local"}, req: req, expectedSource: Local, expectedLog: "falling back to local source"},
+		{name: "fall back to registered", chain: []string{"remote", "test-chain-working"}, req: FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "missing"}, expectedSource: "test-chain-working", expectedLog: "falling back to test-chain-working source"},
+		{name: "unknown backend", chain: []string{"test-chain-unknown", "remote"}, req: req, expectedSource: Remote, expectedLog: `unknown backend "test-chain-unknown"`},
+		{name: "built in skipped", chain: []string{"remote", "test-chain-working"}, req: FetchRequest{LocalPath: "localpath"}, expectedSource: "test-chain-working", expectedLog: "falling back to test-chain-working source - missing fields"},
+		{name: "all fail", chain: []string{"test-chain-broken", "test-chain-broken"}, req: req, expectedErr: "test-chain-broken"},
+		{name: "none can serve", chain: []string{"local"}, req: FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}, invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logBuf := &bytes.Buffer{}
+			fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "key", "secret", WithBackends(test.chain...))
+			fetcher.remote = &namedBackend{name: "remote", data: []byte("remote data")}
+			if test.req.Key == "missing" {
+				fetcher.remote = &namedBackend{name: "remote", err: errNoSuchKey}
+			}
+			fetcher.local = &fakeLocal{data: []byte("local data")}
+
+			fh, source, err := fetcher.Fetch(context.Background(), test.req)
+			if test.expectedLog != "" {
+				assert.Contains(t, logBuf.String(), test.expectedLog)
+			}
+			if test.invalid {
+				assert.True(t, errors.Is(err, ErrInvalidRequest), "got %v", err)
+				return
+			}
+			if test.expectedErr != "" {
+				var fetchErr *FetchError
+				require.True(t, errors.As(err, &fetchErr), "got %v", err)
+				assert.Equal(t, test.expectedErr, fetchErr.Source)
+				assert.True(t, errors.Is(err, ErrNotFound))
+				return
+			}
+
+			require.NoError(t, err)
+			defer fh.Close()
+			assert.Equal(t, test.expectedSource, source)
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, string(test.expectedSource)+" data", string(body))
+		})
+	}
+}
+
+// TestRegisterBackend verifies that backends are listed once registered, and that names cannot be reused
+func TestRegisterBackend(t *testing.T) {
+	registerTestBackend(&namedBackend{name: "test-register"})
+	assert.Contains(t, Backends(), "test-register")
+	assert.Contains(t, Backends(), "remote")
+	assert.Contains(t, Backends(), "local")
+	assert.Contains(t, Backends(), "http")
+
+	for _, name := range []string{"test-register", "remote", "local", "http", ""} {
+		assert.Panics(t, func() { RegisterBackend(&namedBackend{name: name}) }, "name %q", name)
+	}
+}
+
+// TestOSFileStat verifies that the local backend stats files without opening them
+func TestOSFileStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("file data"), 0600))
+
+	info, err := (&osFile{}).Stat(context.Background(), FetchRequest{LocalPath: path})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("file data")), info.Size)
+
+	_, err = (&osFile{}).Stat(context.Background(), FetchRequest{LocalPath: filepath.Join(dir, "missing.eml")})
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,170 @@
+package getter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBatchConcurrency is how many files a batch fetches at once unless told otherwise
+const DefaultBatchConcurrency = 8
+
+// ErrBatchStopped is reported for the requests of a batch that were never started because the batch stopped early
+var ErrBatchStopped = errors.New("batch stopped before the request was started")
+
+// BatchOptions controls how FetchMany and FetchEach work through a batch
+type BatchOptions struct {
+	// Concurrency is how many files are fetched at once, DefaultBatchConcurrency when zero or less
+	Concurrency int
+	// Ordered delivers results in the order of the requests instead of as soon as they are fetched
+	Ordered bool
+	// StopOnError stops starting new fetches once one has failed
+	StopOnError bool
+}
+
+// BatchResult is the outcome of one request of a batch. Exactly one of Result and Err is set.
+// The caller must close Result.Body.
+type BatchResult struct {
+	// Index is the position of Request in the batch
+	Index   int
+	Request FetchRequest
+	Result  *FetchResult
+	Err     error
+}
+
+// FetchMany fetches every request in reqs, delivering one result per request on the returned channel, which is
+// closed once every request has been accounted for. Requests that are never started because ctx was cancelled, or
+// because of StopOnError, are reported with ctx.Err() or ErrBatchStopped. The channel must be drained, closing each
+// result's body.
+func (g *Getter) FetchMany(ctx context.Context, reqs []FetchRequest, opts BatchOptions) <-chan BatchResult {
+	return g.fetchMany(ctx, reqs, opts, &stopper{c: make(chan struct{})})
+}
+
+// FetchEach is FetchMany handing each result to fn in turn instead of a channel. fn is never called concurrently
+// and must close the result's body. If fn returns an error no more fetches are started, the bodies of results fn
+// will not see are closed, and the error is returned. Otherwise FetchEach returns ctx.Err().
+func (g *Getter) FetchEach(ctx context.Context, reqs []FetchRequest, opts BatchOptions, fn func(BatchResult) error) error {
+	stop := &stopper{c: make(chan struct{})}
+	var fnErr error
+	for res := range g.fetchMany(ctx, reqs, opts, stop) {
+		if fnErr != nil {
+			if res.Result != nil {
+				res.Result.Body.Close()
+			}
+			continue
+		}
+		if fnErr = fn(res); fnErr != nil {
+			stop.stop()
+		}
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	return ctx.Err()
+}
+
+// stopper tells a batch to stop starting fetches
+type stopper struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func (s *stopper) stop() {
+	s.once.Do(func() { close(s.c) })
+}
+
+// batchItem is a result on its way out of a batch. started is set when it holds a concurrency slot.
+type batchItem struct {
+	BatchResult
+	started bool
+}
+
+// fetchMany does the work of FetchMany, stopping early when stop is stopped.
+// A fetch holds its concurrency slot until its result has been handed over, so that a caller stopping the
+// batch in response to a result can count on no more than the fetches already running being started.
+func (g *Getter) fetchMany(ctx context.Context, reqs []FetchRequest, opts BatchOptions, stop *stopper) <-chan BatchResult {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	items := make(chan batchItem)
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(items)
+		}()
+
+		for i, req := range reqs {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			case <-stop.c:
+			}
+			if err := batchStopped(ctx, stop); err != nil {
+				for j := i; j < len(reqs); j++ {
+					items <- batchItem{BatchResult: BatchResult{Index: j, Request: reqs[j], Err: err}}
+				}
+				return
+			}
+
+			wg.Add(1)
+			go func(i int, req FetchRequest) {
+				defer wg.Done()
+				res, err := g.FetchObject(ctx, req)
+				items <- batchItem{BatchResult: BatchResult{Index: i, Request: req, Result: res, Err: err}, started: true}
+			}(i, req)
+		}
+	}()
+
+	out := make(chan BatchResult)
+	go func() {
+		defer close(out)
+		deliver := func(item batchItem) {
+			out <- item.BatchResult
+			if item.started {
+				<-sem
+			}
+		}
+
+		pending := map[int]batchItem{}
+		next := 0
+		for item := range items {
+			if item.Err != nil && opts.StopOnError {
+				stop.stop()
+			}
+			if !opts.Ordered {
+				deliver(item)
+				continue
+			}
+			// everything before next was started first, so it already holds a slot and cannot be starved
+			pending[item.Index] = item
+			for {
+				item, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				deliver(item)
+				next++
+			}
+		}
+	}()
+	return out
+}
+
+// batchStopped returns the error to report for requests a batch will not start, or nil to carry on
+func batchStopped(ctx context.Context, stop *stopper) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-stop.c:
+		return ErrBatchStopped
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,190 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyedRemote serves each key as its own content, failing keys listed in errs, and tracks how many
+// fetches are running at once
+type keyedRemote struct {
+	errs  map[string]error
+	delay func(key string) time.Duration
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+	fetched   []string
+}
+
+func (f *keyedRemote) Name() string {
+	return string(Remote)
+}
+
+func (f *keyedRemote) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	f.mu.Lock()
+	f.active++
+	if f.active > f.maxActive {
+		f.maxActive = f.active
+	}
+	f.fetched = append(f.fetched, req.Key)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}()
+
+	if f.delay != nil {
+		time.Sleep(f.delay(req.Key))
+	}
+	if err := f.errs[req.Key]; err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte(req.Key))), ObjectInfo{Size: int64(len(req.Key))}, nil
+}
+
+func (f *keyedRemote) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(req.Key))}, f.errs[req.Key]
+}
+
+// batchFixture returns a remote only Getter over remote, and requests for keys
+func batchFixture(remote *keyedRemote, keys ...string) (*Getter, []FetchRequest) {
+	fetcher := New(discardLogger(), true, "key", "secret")
+	fetcher.remote = remote
+	fetcher.local = &fakeLocal{err: errNoSuchKey}
+	var reqs []FetchRequest
+	for _, key := range keys {
+		reqs = append(reqs, FetchRequest{Host: "host", Bucket: "bucket", Key: key})
+	}
+	return fetcher, reqs
+}
+
+// readBatch drains results, returning the indexes in the order they came and the content or error of each key
+func readBatch(t *testing.T, results <-chan BatchResult) ([]int, map[string]string) {
+	var order []int
+	outcomes := map[string]string{}
+	for res := range results {
+		order = append(order, res.Index)
+		if res.Err != nil {
+			assert.Nil(t, res.Result)
+			outcomes[res.Request.Key] = "error"
+			if errors.Is(res.Err, ErrBatchStopped) {
+				outcomes[res.Request.Key] = "stopped"
+			}
+			continue
+		}
+		body, err := ioutil.ReadAll(res.Result.Body)
+		res.Result.Body.Close()
+		require.NoError(t, err)
+		outcomes[res.Request.Key] = string(body)
+	}
+	return order, outcomes
+}
+
+// TestFetchMany verifies that every request of a batch gets a result, with no more than the allowed number of
+// fetches at once
+func TestFetchMany(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for _, test := range []struct {
+		name        string
+		opts        BatchOptions
+		concurrency int
+	}{
+		{name: "default concurrency", opts: BatchOptions{}, concurrency: DefaultBatchConcurrency},
+		{name: "limited", opts: BatchOptions{Concurrency: 3}, concurrency: 3},
+		{name: "ordered", opts: BatchOptions{Concurrency: 4, Ordered: true}, concurrency: 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			remote := &keyedRemote{
+				errs: map[string]error{"c": errNoSuchKey},
+				// later keys finish first, so completion order differs from request order
+				delay: func(key string) time.Duration { return time.Duration('k'-key[0]) * time.Millisecond },
+			}
+			fetcher, reqs := batchFixture(remote, keys...)
+
+			order, outcomes := readBatch(t, fetcher.FetchMany(context.Background(), reqs, test.opts))
+			require.Len(t, order, len(keys))
+			for _, key := range keys {
+				if key == "c" {
+					assert.Equal(t, "error", outcomes[key])
+				} else {
+					assert.Equal(t, key, outcomes[key])
+				}
+			}
+			assert.True(t, remote.maxActive <= test.concurrency, "%d fetches at once", remote.maxActive)
+			if test.opts.Ordered {
+				assert.True(t, sort.IntsAreSorted(order), "got %v", order)
+			}
+			sort.Ints(order)
+			for i := range order {
+				assert.Equal(t, i, order[i])
+			}
+		})
+	}
+}
+
+// TestFetchManyStop verifies that batches stop starting fetches on cancellation or, when asked, the first error
+func TestFetchManyStop(t *testing.T) {
+	remote := &keyedRemote{errs: map[string]error{"b": errNoSuchKey}}
+	fetcher, reqs := batchFixture(remote, "a", "b", "c", "d")
+
+	_, outcomes := readBatch(t, fetcher.FetchMany(context.Background(), reqs, BatchOptions{Concurrency: 1, StopOnError: true}))
+	assert.Equal(t, map[string]string{"a": "a", "b": "error", "c": "stopped", "d": "stopped"}, outcomes)
+	assert.Equal(t, []string{"a", "b"}, remote.fetched)
+
+	remote.fetched = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for res := range fetcher.FetchMany(ctx, reqs, BatchOptions{}) {
+		assert.Equal(t, context.Canceled, res.Err)
+	}
+	assert.Empty(t, remote.fetched)
+}
+
+// TestFetchEach verifies that results are handed to the callback, and that a callback error ends the batch
+func TestFetchEach(t *testing.T) {
+	remote := &keyedRemote{}
+	fetcher, reqs := batchFixture(remote, "a", "b", "c", "d", "e")
+
+	var seen []string
+	err := fetcher.FetchEach(context.Background(), reqs, BatchOptions{Ordered: true}, func(res BatchResult) error {
+		require.NoError(t, res.Err)
+		defer res.Result.Body.Close()
+		seen = append(seen, res.Request.Key)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, seen)
+
+	remote.fetched = nil
+	seen = nil
+	err = fetcher.FetchEach(context.Background(), reqs, BatchOptions{Concurrency: 1, Ordered: true}, func(res BatchResult) error {
+		res.Result.Body.Close()
+		seen = append(seen, res.Request.Key)
+		if res.Request.Key == "b" {
+			return assert.AnError
+		}
+		return nil
+	})
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, []string{"a", "b"}, seen)
+	// c may have been started while the callback looked at b, nothing after it is
+	assert.NotContains(t, remote.fetched, "d")
+	assert.NotContains(t, remote.fetched, "e")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = fetcher.FetchEach(ctx, reqs, BatchOptions{}, func(res BatchResult) error { return nil })
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,280 @@
+package getter
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// CircuitState allows us to have a type safe value describing the circuit breaker of a remote host
+type CircuitState string
+
+const (
+	// CircuitClosed signifies the host is healthy and fetches go to it
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen signifies the host is failing and fetches go straight to the local source
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen signifies a few probe fetches are let through to see if the host has recovered
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// ErrCircuitOpen is returned for remote fetches that were not attempted because the host's circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerSettings controls the per host circuit breaker. The circuit opens when either trip condition is met.
+type BreakerSettings struct {
+	// FailureThreshold opens the circuit after this many failures in a row, zero disables the check
+	FailureThreshold int
+	// FailureRate opens the circuit once this fraction of the fetches within Window have failed,
+	// zero disables the check
+	FailureRate float64
+	// MinRequests is how many fetches Window must hold before FailureRate is checked
+	MinRequests int
+	// Window is the period FailureRate is measured over, one minute when zero
+	Window time.Duration
+	// OpenTimeout is how long the circuit stays open before probing the host, thirty seconds when zero
+	OpenTimeout time.Duration
+	// HalfOpenProbes is how many probe fetches may run at once while half-open, and how many must
+	// succeed to close the circuit again. One when zero.
+	HalfOpenProbes int
+}
+
+// WithCircuitBreaker sends fetches for failing remote hosts straight to the local source, as configured by s
+func WithCircuitBreaker(s BreakerSettings) Option {
+	return func(g *Getter) {
+		if s.Window <= 0 {
+			s.Window = time.Minute
+		}
+		if s.OpenTimeout <= 0 {
+			s.OpenTimeout = 30 * time.Second
+		}
+		if s.HalfOpenProbes <= 0 {
+			s.HalfOpenProbes = 1
+		}
+		g.breakerSettings = &s
+	}
+}
+
+// CircuitState reports the state of the circuit breaker for host. Hosts without a breaker are always closed.
+func (g *Getter) CircuitState(host string) CircuitState {
+	if g.breakers == nil {
+		return CircuitClosed
+	}
+	return g.breakers.state(host)
+}
+
+// breakers holds the circuit of every remote host seen so far
+type breakers struct {
+	mu       sync.Mutex
+	settings BreakerSettings
+	circuits map[string]*circuit
+	clock    Clock
+	logger   *log.Logger
+}
+
+// circuit is the breaker for a single host
+type circuit struct {
+	state CircuitState
+
+	// closed bookkeeping
+	consecutiveFailures int
+	windowStart         time.Time
+	requests            int
+	failures            int
+
+	// open and half-open bookkeeping
+	openedAt       time.Time
+	probesInFlight int
+	probeSuccesses int
+
+	// generation counts state changes, so outcomes of fetches let through in an earlier state can be told apart
+	generation int
+}
+
+// admission records the state of the circuit a fetch was let through in, to hand back to done
+type admission struct {
+	state      CircuitState
+	generation int
+}
+
+func newBreakers(settings BreakerSettings, clock Clock, logger *log.Logger) *breakers {
+	return &breakers{
+		settings: settings,
+		circuits: map[string]*circuit{},
+		clock:    clock,
+		logger:   logger,
+	}
+}
+
+// allow reports whether a fetch from host may go ahead. Every allowed fetch must be followed by a call to done
+// with the returned admission.
+func (b *breakers) allow(host string) (admission, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(host)
+	b.checkTimeout(host, c)
+	switch c.state {
+	case CircuitOpen:
+		return admission{}, false
+	case CircuitHalfOpen:
+		if c.probesInFlight >= b.settings.HalfOpenProbes {
+			return admission{}, false
+		}
+		c.probesInFlight++
+	}
+	return admission{state: c.state, generation: c.generation}, true
+}
+
+// done records the outcome of a fetch from host that allow let through as a
+func (b *breakers) done(host string, a admission, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(host)
+	if a.generation != c.generation {
+		// the circuit changed state while the fetch ran, so its outcome belongs to a state that is gone
+		return
+	}
+	failed := isHostFailure(err)
+	if c.state == CircuitHalfOpen {
+		c.probesInFlight--
+		switch {
+		case failed:
+			b.trip(host, c, err)
+		case !isContextErr(err):
+			c.probeSuccesses++
+			if c.probeSuccesses >= b.settings.HalfOpenProbes {
+				b.setState(host, c, CircuitClosed)
+				b.reset(c)
+			}
+		}
+		return
+	}
+	if err != nil && isContextErr(err) {
+		// this fetch tells us nothing about the host
+		return
+	}
+
+	now := b.clock.Now()
+	if now.Sub(c.windowStart) >= b.settings.Window {
+		c.windowStart, c.requests, c.failures = now, 0, 0
+	}
+	c.requests++
+	if !failed {
+		c.consecutiveFailures = 0
+		return
+	}
+	c.failures++
+	c.consecutiveFailures++
+
+	s := b.settings
+	if (s.FailureThreshold > 0 && c.consecutiveFailures >= s.FailureThreshold) ||
+		(s.FailureRate > 0 && c.requests >= s.MinRequests && float64(c.failures)/float64(c.requests) >= s.FailureRate) {
+		b.trip(host, c, err)
+	}
+}
+
+// state returns the current state of host's circuit
+func (b *breakers) state(host string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		return CircuitClosed
+	}
+	b.checkTimeout(host, c)
+	return c.state
+}
+
+// circuit returns the circuit for host, creating a closed one if needed. b.mu must be held.
+func (b *breakers) circuit(host string) *circuit {
+	c, ok := b.circuits[host]
+	if !ok {
+		c = &circuit{state: CircuitClosed, windowStart: b.clock.Now()}
+		b.circuits[host] = c
+	}
+	return c
+}
+
+// checkTimeout moves an open circuit to half-open once it has been open long enough. b.mu must be held.
+func (b *breakers) checkTimeout(host string, c *circuit) {
+	if c.state == CircuitOpen && b.clock.Now().Sub(c.openedAt) >= b.settings.OpenTimeout {
+		c.probesInFlight, c.probeSuccesses = 0, 0
+		b.setState(host, c, CircuitHalfOpen)
+	}
+}
+
+// trip opens the circuit. b.mu must be held.
+func (b *breakers) trip(host string, c *circuit, err error) {
+	c.openedAt = b.clock.Now()
+	b.reset(c)
+	b.logger.Printf("circuit breaker for host %q tripped - %v", host, err)
+	b.setState(host, c, CircuitOpen)
+}
+
+// reset clears the failure counts of a circuit. b.mu must be held.
+func (b *breakers) reset(c *circuit) {
+	c.consecutiveFailures, c.requests, c.failures = 0, 0, 0
+	c.windowStart = b.clock.Now()
+}
+
+// setState moves the circuit to state and logs the change. b.mu must be held.
+func (b *breakers) setState(host string, c *circuit, state CircuitState) {
+	if c.state == state {
+		return
+	}
+	b.logger.Printf("circuit breaker for host %q changed from %s to %s", host, c.state, state)
+	c.state = state
+	c.generation++
+}
+
+// isHostFailure reports whether err says something is wrong with the host itself. An error response
+// below 500, such as a missing key or denied access, shows the host is up and answering. Neither a
+// requestError nor a file that is too large say anything about the host.
+func isHostFailure(err error) bool {
+	if err == nil || isContextErr(err) || isRequestError(err) || errors.Cause(err) == ErrTooLarge {
+		return false
+	}
+	if httpErr, ok := errors.Cause(err).(*HTTPError); ok {
+		return httpErr.StatusCode >= 500
+	}
+	resp := minio.ToErrorResponse(errors.Cause(err))
+	return resp.Code == "" || resp.StatusCode >= 500
+}
+
+// requestError is a failure of a request the host had no part in, such as an SSE-C key that cannot be sent
+type requestError struct {
+	error
+}
+
+// Cause returns the failure, so that it is what gets classified
+func (e requestError) Cause() error {
+	return e.error
+}
+
+// isRequestError reports whether err is, or wraps, a requestError
+func isRequestError(err error) bool {
+	for err != nil {
+		if _, ok := err.(requestError); ok {
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
+
+// isContextErr reports whether err comes from a cancelled or expired context
+func isContextErr(err error) bool {
+	cause := errors.Cause(err)
+	return cause == context.Canceled || cause == context.DeadlineExceeded
+}
@@ -0,0 +1,250 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// repeatErr returns err n times over
+func repeatErr(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// breakerFixture is a Getter with a circuit breaker, a fake clock and a scripted remote
+type breakerFixture struct {
+	fetcher *Getter
+	remote  *flakyRemote
+	clock   *fakeClock
+	logBuf  *bytes.Buffer
+}
+
+func newBreakerFixture(settings BreakerSettings, remoteErrs []error) *breakerFixture {
+	f := &breakerFixture{
+		remote: &flakyRemote{data: []byte("remote data"), errs: remoteErrs},
+		clock:  newFakeClock(),
+		logBuf: &bytes.Buffer{},
+	}
+	f.fetcher = New(log.New(f.logBuf, "test", log.LstdFlags), true, "key", "secret", WithCircuitBreaker(settings), WithClock(f.clock))
+	f.fetcher.remote = f.remote
+	f.fetcher.local = &fakeLocal{data: []byte("local data")}
+	return f
+}
+
+// fetch fetches from host and returns the source that served it
+func (f *breakerFixture) fetch(t *testing.T, host string) Source {
+	fh, source, err := f.fetcher.FetchFile("localpath", host, "bucket", "key")
+	require.NoError(t, err)
+	fh.Close()
+	return source
+}
+
+// TestCircuitBreakerConsecutiveFailures verifies the closed, open, half-open, closed cycle
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	f := newBreakerFixture(BreakerSettings{FailureThreshold: 3, OpenTimeout: 30 * time.Second}, repeatErr(errUnavailable, 3))
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, CircuitClosed, f.fetcher.CircuitState("host"))
+		assert.Equal(t, Local, f.fetch(t, "host"))
+	}
+	assert.Equal(t, CircuitOpen, f.fetcher.CircuitState("host"))
+	assert.Contains(t, f.logBuf.String(), `circuit breaker for host "host" changed from closed to open`)
+
+	// while open the remote is skipped entirely
+	assert.Equal(t, Local, f.fetch(t, "host"))
+	assert.Equal(t, 3, f.remote.calls)
+	assert.Contains(t, f.logBuf.String(), `falling back to local source - host "host": circuit breaker open`)
+
+	// other hosts are unaffected
+	assert.Equal(t, Remote, f.fetch(t, "other"))
+	assert.Equal(t, CircuitClosed, f.fetcher.CircuitState("other"))
+
+	f.clock.Advance(30 * time.Second)
+	assert.Equal(t, CircuitHalfOpen, f.fetcher.CircuitState("host"))
+	assert.Equal(t, Remote, f.fetch(t, "host"))
+	assert.Equal(t, CircuitClosed, f.fetcher.CircuitState("host"))
+	assert.Contains(t, f.logBuf.String(), `circuit breaker for host "host" changed from half-open to closed`)
+}
+
+// TestCircuitBreakerProbeFailure verifies that a failed probe opens the circuit again
+func TestCircuitBreakerProbeFailure(t *testing.T) {
+	f := newBreakerFixture(BreakerSettings{FailureThreshold: 1, OpenTimeout: time.Minute}, repeatErr(errUnavailable, 2))
+
+	assert.Equal(t, Local, f.fetch(t, "host"))
+	assert.Equal(t, CircuitOpen, f.fetcher.CircuitState("host"))
+
+	f.clock.Advance(time.Minute)
+	assert.Equal(t, Local, f.fetch(t, "host"))
+	assert.Equal(t, CircuitOpen, f.fetcher.CircuitState("host"))
+	assert.Equal(t, 2, f.remote.calls)
+
+	f.clock.Advance(59 * time.Second)
+	assert.Equal(t, CircuitOpen, f.fetcher.CircuitState("host"), "open timeout restarts when a probe fails")
+}
+
+// TestCircuitBreakerHalfOpenProbes verifies that only the configured number of probes run while half-open
+func TestCircuitBreakerHalfOpenProbes(t *testing.T) {
+	clock := newFakeClock()
+	b := newBreakers(BreakerSettings{FailureThreshold: 1, OpenTimeout: time.Second, HalfOpenProbes: 2, Window: time.Minute}, clock, discardLogger())
+
+	first, ok := b.allow("host")
+	require.True(t, ok)
+	b.done("host", first, errUnavailable)
+	_, ok = b.allow("host")
+	assert.False(t, ok)
+
+	clock.Advance(time.Second)
+	probe1, ok := b.allow("host")
+	assert.True(t, ok)
+	probe2, ok := b.allow("host")
+	assert.True(t, ok)
+	_, ok = b.allow("host")
+	assert.False(t, ok, "only two probes may be in flight")
+
+	b.done("host", probe1, nil)
+	assert.Equal(t, CircuitHalfOpen, b.state("host"), "closing takes two successful probes")
+	b.done("host", probe2, nil)
+	assert.Equal(t, CircuitClosed, b.state("host"))
+}
+
+// TestCircuitBreakerStaleOutcomes verifies that fetches finishing after the circuit changed state are ignored
+func TestCircuitBreakerStaleOutcomes(t *testing.T) {
+	clock := newFakeClock()
+	b := newBreakers(BreakerSettings{FailureThreshold: 1, OpenTimeout: time.Second, HalfOpenProbes: 1, Window: time.Minute}, clock, discardLogger())
+
+	slow, ok := b.allow("host")
+	require.True(t, ok)
+	tripping, ok := b.allow("host")
+	require.True(t, ok)
+	b.done("host", tripping, errUnavailable)
+	require.Equal(t, CircuitOpen, b.state("host"))
+
+	clock.Advance(time.Second)
+	probe, ok := b.allow("host")
+	require.True(t, ok)
+
+	// the fetch let through while closed finishes during the probe and must not count as one
+	b.done("host", slow, nil)
+	assert.Equal(t, CircuitHalfOpen, b.state("host"))
+	assert.Equal(t, 1, b.circuits["host"].probesInFlight)
+	_, ok = b.allow("host")
+	assert.False(t, ok, "the probe is still in flight")
+
+	b.done("host", probe, errUnavailable)
+	assert.Equal(t, CircuitOpen, b.state("host"))
+	assert.Equal(t, 0, b.circuits["host"].probesInFlight)
+}
+
+// TestCircuitBreakerFailureRate verifies that the circuit opens on the failure rate over the window
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	clock := newFakeClock()
+	b := newBreakers(BreakerSettings{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, OpenTimeout: time.Second, HalfOpenProbes: 1}, clock, discardLogger())
+
+	outcome := func(err error) {
+		a, ok := b.allow("host")
+		require.True(t, ok)
+		b.done("host", a, err)
+	}
+
+	outcome(nil)
+	outcome(errUnavailable)
+	outcome(nil)
+	assert.Equal(t, CircuitClosed, b.state("host"), "not enough requests to judge the rate")
+
+	// a new window forgets the earlier failure
+	clock.Advance(time.Minute)
+	outcome(nil)
+	outcome(nil)
+	outcome(errUnavailable)
+	assert.Equal(t, CircuitClosed, b.state("host"))
+	outcome(errUnavailable)
+	assert.Equal(t, CircuitOpen, b.state("host"))
+}
+
+// TestCircuitBreakerClientErrors verifies that errors showing a healthy host do not trip the circuit
+func TestCircuitBreakerClientErrors(t *testing.T) {
+	f := newBreakerFixture(BreakerSettings{FailureThreshold: 2}, repeatErr(errNoSuchKey, 5))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, Local, f.fetch(t, "host"))
+	}
+	assert.Equal(t, CircuitClosed, f.fetcher.CircuitState("host"))
+	assert.Equal(t, 5, f.remote.calls)
+}
+
+// TestCircuitBreakerRequestErrors verifies that failures the host had no part in do not trip the circuit
+func TestCircuitBreakerRequestErrors(t *testing.T) {
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "mail.eml", []byte("remote data"))
+	data := []byte("http data")
+	// ignoring serves the whole file whatever range is asked for, and does not say how large it is
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+		w.(http.Flusher).Flush()
+	}))
+	defer ignoring.Close()
+	var requests int64
+	sized := newHTTPServer(data, &requests)
+	defer sized.Close()
+	key := bytes.Repeat([]byte("k"), 32)
+
+	for _, test := range []struct {
+		name string
+		opts []Option
+		req  FetchRequest
+		host string
+	}{
+		{name: "sse-c key over plain http", opts: []Option{WithSSECKeys(StaticKeys{Buckets: map[string][]byte{"bucket": key}})},
+			req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}, host: s3.Host()},
+		{name: "key provider fails", opts: []Option{WithSSECKeys(KeyProviderFunc(func(ctx context.Context, bucket, key string) ([]byte, error) {
+			return nil, assert.AnError
+		}))}, req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}, host: s3.Host()},
+		{name: "invalid key length", opts: []Option{WithSecure(), WithSSECKeys(StaticKeys{Buckets: map[string][]byte{"bucket": key[:16]}})},
+			req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}, host: s3.Host()},
+		{name: "too large", opts: []Option{WithHTTPSettings(HTTPSettings{MaxSize: 1})},
+			req: FetchRequest{URL: sized.URL + "/mail.eml"}, host: urlHost(sized.URL)},
+		{name: "range beyond an ignored range", req: FetchRequest{URL: ignoring.URL + "/mail.eml", Range: &ByteRange{Offset: 100}},
+			host: urlHost(ignoring.URL)},
+		{name: "suffix of an ignored range", req: FetchRequest{URL: ignoring.URL + "/mail.eml", Range: &ByteRange{Offset: -4}},
+			host: urlHost(ignoring.URL)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append([]Option{WithStrategy(RemoteOnly), WithCircuitBreaker(BreakerSettings{FailureThreshold: 2})}, test.opts...)
+			fetcher := New(discardLogger(), true, "key", "secret", opts...)
+			for i := 0; i < 3; i++ {
+				_, _, err := fetcher.Fetch(context.Background(), test.req)
+				require.Error(t, err)
+				assert.NotEqual(t, ErrCircuitOpen, err.(*FetchError).Kind, "%v", err)
+			}
+			assert.Equal(t, CircuitClosed, fetcher.CircuitState(test.host))
+		})
+	}
+}
+
+// TestCircuitBreakerStopsRetries verifies that a circuit opening part way through stops further retries
+func TestCircuitBreakerStopsRetries(t *testing.T) {
+	f := newBreakerFixture(BreakerSettings{FailureThreshold: 2}, repeatErr(errUnavailable, 5))
+	f.fetcher.retry = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+
+	assert.Equal(t, Local, f.fetch(t, "host"))
+	assert.Equal(t, 2, f.remote.calls)
+	assert.Equal(t, CircuitOpen, f.fetcher.CircuitState("host"))
+}
+
+// TestCircuitStateWithoutBreaker verifies that Getters without a breaker report every circuit closed
+func TestCircuitStateWithoutBreaker(t *testing.T) {
+	fetcher := New(discardLogger(), true, "key", "secret")
+	assert.Equal(t, CircuitClosed, fetcher.CircuitState("host"))
+}
@@ -0,0 +1,388 @@
+package getter
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/pkg/encrypt"
+	"github.com/pkg/errors"
+)
+
+// cacheTempPrefix marks files that are still being written, and are not part of the cache yet
+const cacheTempPrefix = "tmp-"
+
+// DiskCache keeps copies of remote files in a directory so hot files are not downloaded again while they are
+// unchanged. Files are cached by host, bucket, key, and ETag, so a new version of a file is never served from an
+// older copy. Once the cache grows past its size cap the least recently used files are removed.
+// The directory is rescanned by NewDiskCache, so a cache survives restarts.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	now      func() time.Time
+
+	mu sync.Mutex
+	// entries finds the element of lru holding each cached file by name
+	entries map[string]*list.Element
+	// lru holds *cacheEntry, most recently used first
+	lru  *list.List
+	size int64
+}
+
+// cacheEntry is a file in the cache directory
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// NewDiskCache creates a cache of at most maxBytes in dir, creating dir if needed.
+// Files already in dir are kept, oldest first in line for eviction.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if maxBytes <= 0 {
+		return nil, errors.Errorf("cache size cap must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create cache directory")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read cache directory")
+	}
+
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		now:      time.Now,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+
+	// modification times are bumped on every hit, so they give the order files were last used in
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), cacheTempPrefix) {
+			// left behind by a write that never finished
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		c.entries[info.Name()] = c.lru.PushFront(&cacheEntry{name: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// WithDiskCache serves remote files from c while they are unchanged, and stores what is fetched in it.
+// Files served from the cache are reported as Cached. The remote file system is still asked for the current
+// ETag of each file, so files are only served while the remote file system is reachable.
+func WithDiskCache(c *DiskCache) Option {
+	return func(g *Getter) {
+		g.cache = c
+	}
+}
+
+// Size returns the number of bytes the cache currently takes up
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// fetchRemoteCached is fetchRemote going through the disk cache when there is one and the strategy allows it
+func (g *Getter) fetchRemoteCached(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, Source, error) {
+	if g.cache == nil || g.strategy == RemoteOnly {
+		fh, info, err := g.fetchRemote(ctx, req)
+		return fh, info, Remote, err
+	}
+
+	current, err := g.statRemote(ctx, req)
+	if err != nil {
+		return nil, ObjectInfo{}, Remote, err
+	}
+	if current.ServerSideEncryption == string(encrypt.SSEC) {
+		// the whole point of a customer key is that the content is not kept in the clear
+		fh, info, err := g.fetchRemote(ctx, req)
+		return fh, info, Remote, err
+	}
+	if fh, info, ok := g.cache.open(req, current.ETag); ok {
+		return fh, info, Cached, nil
+	}
+
+	fh, info, err := g.fetchRemote(ctx, req)
+	if err != nil || req.Range != nil {
+		// only whole files are cached
+		return fh, info, Remote, err
+	}
+	w, err := g.cache.newWriter(req, info, fh, g.logger)
+	if err != nil {
+		g.logger.Printf("unable to cache remote file - %v", err)
+		return fh, info, Remote, nil
+	}
+	return w, info, Remote, nil
+}
+
+// cacheName returns the name of the file caching a version of the remote file described by req
+func cacheName(req FetchRequest, etag string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{req.Host, req.Bucket, req.Key, etag}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// open returns the cached copy of the version etag of the file described by req, limited to req.Range when
+// one is set. ok is false if there is no such copy.
+// Cache files are the JSON encoded ObjectInfo of the file on one line followed by its content.
+func (c *DiskCache) open(req FetchRequest, etag string) (rc io.ReadCloser, info ObjectInfo, ok bool) {
+	if etag == "" {
+		return nil, ObjectInfo{}, false
+	}
+	name := cacheName(req, etag)
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, ObjectInfo{}, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	fh, err := os.Open(path)
+	if err != nil {
+		c.remove(name)
+		return nil, ObjectInfo{}, false
+	}
+	header, err := bufio.NewReader(fh).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(header, &info)
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = fh.Stat()
+	}
+	if err != nil || stat.Size()-int64(len(header)) != info.Size {
+		// not something we wrote, or not all of it
+		fh.Close()
+		c.remove(name)
+		return nil, ObjectInfo{}, false
+	}
+
+	now := c.now()
+	os.Chtimes(path, now, now)
+
+	start, length := int64(0), info.Size
+	if req.Range != nil {
+		if start, length, err = req.Range.bounds(info.Size); err != nil {
+			fh.Close()
+			return nil, ObjectInfo{}, false
+		}
+		info.Size = length
+	}
+	section := io.NewSectionReader(fh, int64(len(header))+start, length)
+	return &sectionFile{SectionReader: section, Closer: fh}, info, true
+}
+
+// newWriter returns body, copying it into the cache as it is read. The copy is only added to the cache once
+// body has been read to the end and matches info.
+func (c *DiskCache) newWriter(req FetchRequest, info ObjectInfo, body io.ReadCloser, logger *log.Logger) (io.ReadCloser, error) {
+	if info.ETag == "" || info.Size > c.maxBytes {
+		return body, nil
+	}
+	header, err := json.Marshal(info)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode file info")
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, cacheTempPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create cache file")
+	}
+	if _, err := tmp.Write(append(header, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, errors.Wrap(err, "unable to write cache file")
+	}
+
+	w := &cacheWriter{
+		ReadCloser: body,
+		cache:      c,
+		logger:     logger,
+		name:       cacheName(req, info.ETag),
+		tmp:        tmp,
+		written:    int64(len(header)) + 1,
+		remaining:  info.Size,
+	}
+	if sum := etagChecksum(info.ETag); sum != nil {
+		w.hash, w.sum = md5.New(), sum.Value
+	}
+	return w, nil
+}
+
+// add records a file that has been moved into the cache directory, evicting others to make room for it
+func (c *DiskCache) add(name string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		// the same version was written twice at once, the rename replaced the other copy
+		entry := elem.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, size: size})
+		c.size += size
+	}
+	c.evict()
+}
+
+// remove drops a file from the cache
+func (c *DiskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// evict removes the least recently used files until the cache fits its cap. c.mu must be held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement deletes the file of elem. c.mu must be held.
+// Readers that already opened the file keep reading it, it is only unlinked.
+func (c *DiskCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.name))
+}
+
+// cacheWriter copies what is read from a remote file into a temporary file, which is renamed into the
+// cache once the whole file has been read. Anything else, a read error, closing early, or seeking,
+// abandons the copy without affecting the reader.
+type cacheWriter struct {
+	io.ReadCloser
+	cache  *DiskCache
+	logger *log.Logger
+	name   string
+
+	// tmp is nil once the copy is finished or abandoned
+	tmp       *os.File
+	written   int64
+	remaining int64
+	// hash checks the content against sum, a plain MD5 ETag, when there is one
+	hash hash.Hash
+	sum  string
+}
+
+// Read reads from the remote file, copying what is read into the cache
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if w.tmp == nil {
+		return n, err
+	}
+
+	if n > 0 {
+		if _, werr := w.tmp.Write(p[:n]); werr != nil {
+			w.logger.Printf("unable to cache remote file - %v", werr)
+			w.abandon()
+			return n, err
+		}
+		if w.hash != nil {
+			w.hash.Write(p[:n])
+		}
+		w.written += int64(n)
+		w.remaining -= int64(n)
+	}
+	if err == io.EOF {
+		w.commit()
+	} else if err != nil {
+		w.abandon()
+	}
+	return n, err
+}
+
+// commit moves the finished copy into the cache if it is complete and intact
+func (w *cacheWriter) commit() {
+	if w.remaining != 0 || (w.hash != nil && hex.EncodeToString(w.hash.Sum(nil)) != strings.ToLower(w.sum)) {
+		w.abandon()
+		return
+	}
+
+	tmp := w.tmp
+	w.tmp = nil
+	err := tmp.Close()
+	if err == nil {
+		now := w.cache.now()
+		err = os.Chtimes(tmp.Name(), now, now)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(w.cache.dir, w.name))
+	}
+	if err != nil {
+		w.logger.Printf("unable to cache remote file - %v", err)
+		os.Remove(tmp.Name())
+		return
+	}
+	w.cache.add(w.name, w.written)
+}
+
+// abandon throws away the copy
+func (w *cacheWriter) abandon() {
+	if w.tmp == nil {
+		return
+	}
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+	w.tmp = nil
+}
+
+// Close closes the remote file, throwing away the copy if the file was not read to the end
+func (w *cacheWriter) Close() error {
+	w.abandon()
+	return w.ReadCloser.Close()
+}
+
+// unwrap returns the remote file
+func (w *cacheWriter) unwrap() io.ReadCloser {
+	return w.ReadCloser
+}
+
+// Seek seeks the remote file if it supports seeking. The copy is thrown away since it would have gaps.
+func (w *cacheWriter) Seek(offset int64, whence int) (int64, error) {
+	w.abandon()
+	s, ok := w.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("remote file does not support seeking")
+	}
+	return s.Seek(offset, whence)
+}
+
+// ReadAt reads from the remote file if it supports it. The copy is thrown away since it would have gaps.
+func (w *cacheWriter) ReadAt(p []byte, off int64) (int, error) {
+	w.abandon()
+	r, ok := w.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("remote file does not support reading at an offset")
+	}
+	return r.ReadAt(p, off)
+}
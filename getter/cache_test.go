@@ -0,0 +1,198 @@
+package getter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheFixture is a fake S3 with a Getter caching it in a temporary directory
+type cacheFixture struct {
+	s3      *fakeS3
+	dir     string
+	cache   *DiskCache
+	fetcher *Getter
+}
+
+func newCacheFixture(t *testing.T, maxBytes int64) *cacheFixture {
+	dir, err := ioutil.TempDir("", "getter-cache")
+	require.NoError(t, err)
+	cache, err := NewDiskCache(dir, maxBytes)
+	require.NoError(t, err)
+	s3 := newFakeS3(t)
+	return &cacheFixture{
+		s3:      s3,
+		dir:     dir,
+		cache:   cache,
+		fetcher: New(discardLogger(), true, "key", "secret", WithDiskCache(cache)),
+	}
+}
+
+func (f *cacheFixture) Close() {
+	f.s3.Close()
+	os.RemoveAll(f.dir)
+}
+
+// fetch reads the whole of key, returning its content and where it came from
+func (f *cacheFixture) fetch(t *testing.T, key string) (string, Source) {
+	fh, source, err := f.fetcher.Fetch(context.Background(), FetchRequest{Host: f.s3.Host(), Bucket: "bucket", Key: key})
+	require.NoError(t, err)
+	defer fh.Close()
+	body, err := ioutil.ReadAll(fh)
+	require.NoError(t, err)
+	return string(body), source
+}
+
+// files returns the names of the files in the cache directory
+func (f *cacheFixture) files(t *testing.T) []string {
+	infos, err := ioutil.ReadDir(f.dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// TestDiskCache verifies that unchanged remote files are served from the cache, and changed ones are fetched again
+func TestDiskCache(t *testing.T) {
+	f := newCacheFixture(t, 1<<20)
+	defer f.Close()
+	f.s3.PutWithHeader("bucket", "mail.eml", []byte("first version"), http.Header{"X-Amz-Meta-Mail-Id": []string{"42"}})
+
+	body, source := f.fetch(t, "mail.eml")
+	assert.Equal(t, "first version", body)
+	assert.Equal(t, Remote, source)
+	gets := atomic.LoadInt64(&f.s3.getRequests)
+
+	body, source = f.fetch(t, "mail.eml")
+	assert.Equal(t, "first version", body)
+	assert.Equal(t, Cached, source)
+	assert.Equal(t, gets, atomic.LoadInt64(&f.s3.getRequests), "the content is not downloaded again")
+
+	res, err := f.fetcher.FetchObject(context.Background(), FetchRequest{Host: f.s3.Host(), Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, Cached, res.Source)
+	assert.Equal(t, int64(len("first version")), res.Size)
+	assert.Equal(t, map[string]string{"Mail-Id": "42"}, res.Metadata, "the cache keeps the file's info")
+	assert.True(t, fakeS3ModTime.Equal(res.LastModified))
+
+	fh, source, err := f.fetcher.FetchRange(context.Background(), FetchRequest{Host: f.s3.Host(), Bucket: "bucket", Key: "mail.eml"}, 6, 3)
+	require.NoError(t, err)
+	rangeBody, err := ioutil.ReadAll(fh)
+	fh.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "ver", string(rangeBody))
+	assert.Equal(t, Cached, source, "ranges are served from cached files")
+
+	f.s3.Put("bucket", "mail.eml", []byte("second version"))
+	body, source = f.fetch(t, "mail.eml")
+	assert.Equal(t, "second version", body)
+	assert.Equal(t, Remote, source, "a new ETag is fetched again")
+	body, source = f.fetch(t, "mail.eml")
+	assert.Equal(t, "second version", body)
+	assert.Equal(t, Cached, source)
+}
+
+// TestDiskCacheRestart verifies that a new cache picks up the files an earlier one left in its directory
+func TestDiskCacheRestart(t *testing.T) {
+	f := newCacheFixture(t, 1<<20)
+	defer f.Close()
+	f.s3.Put("bucket", "mail.eml", []byte("file data"))
+	f.fetch(t, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(f.dir, cacheTempPrefix+"unfinished"), []byte("partial"), 0600))
+
+	cache, err := NewDiskCache(f.dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, f.cache.Size(), cache.Size())
+	assert.Len(t, f.files(t), 1, "unfinished writes are cleaned up")
+
+	f.fetcher = New(discardLogger(), true, "key", "secret", WithDiskCache(cache))
+	body, source := f.fetch(t, "mail.eml")
+	assert.Equal(t, "file data", body)
+	assert.Equal(t, Cached, source)
+}
+
+// TestDiskCacheEviction verifies that the least recently used files are evicted once the cache is over its cap
+func TestDiskCacheEviction(t *testing.T) {
+	data := strings.Repeat("x", 1000)
+	// room for two files and their headers, but not three
+	f := newCacheFixture(t, 2600)
+	defer f.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		f.s3.Put("bucket", key, []byte(data+key))
+	}
+	now := time.Now()
+	f.cache.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	f.fetch(t, "a")
+	f.fetch(t, "b")
+	_, source := f.fetch(t, "a")
+	assert.Equal(t, Cached, source)
+	f.fetch(t, "c")
+	assert.Len(t, f.files(t), 2)
+	assert.True(t, f.cache.Size() <= 2600)
+
+	_, source = f.fetch(t, "a")
+	assert.Equal(t, Cached, source, "a was used more recently than b")
+	_, source = f.fetch(t, "b")
+	assert.Equal(t, Remote, source, "b was evicted")
+
+	// restarting keeps the order files were used in, with room for one of them
+	cache, err := NewDiskCache(f.dir, 1300)
+	require.NoError(t, err)
+	f.fetcher = New(discardLogger(), true, "key", "secret", WithDiskCache(cache))
+	_, source = f.fetch(t, "b")
+	assert.Equal(t, Cached, source, "b was used last")
+	_, source = f.fetch(t, "a")
+	assert.Equal(t, Remote, source)
+}
+
+// TestDiskCacheIncomplete verifies that files which are not read to the end, or do not match their ETag, are not cached
+func TestDiskCacheIncomplete(t *testing.T) {
+	f := newCacheFixture(t, 1<<20)
+	defer f.Close()
+	f.s3.Put("bucket", "mail.eml", []byte("file data"))
+	f.s3.PutWithHeader("bucket", "corrupt.eml", []byte("file data"), http.Header{"Etag": []string{`"` + strings.Repeat("0", 32) + `"`}})
+
+	fh, _, err := f.fetcher.Fetch(context.Background(), FetchRequest{Host: f.s3.Host(), Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	_, err = fh.Read(make([]byte, 4))
+	require.NoError(t, err)
+	fh.Close()
+	assert.Empty(t, f.files(t))
+
+	f.fetch(t, "corrupt.eml")
+	assert.Empty(t, f.files(t))
+	_, source := f.fetch(t, "corrupt.eml")
+	assert.Equal(t, Remote, source)
+
+	rs, _, err := f.fetcher.FetchSeekable(context.Background(), FetchRequest{Host: f.s3.Host(), Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	_, err = rs.Seek(5, 0)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(rs)
+	rs.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(body))
+	assert.Empty(t, f.files(t), "seeking leaves gaps, so the file is not cached")
+}
+
+// TestNewDiskCacheInvalid verifies that caches without room are rejected
+func TestNewDiskCacheInvalid(t *testing.T) {
+	_, err := NewDiskCache(os.TempDir(), 0)
+	assert.Error(t, err)
+}
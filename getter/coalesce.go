@@ -0,0 +1,358 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCoalesceMemory is how much of a shared download WithCoalescing keeps in memory by default
+const DefaultCoalesceMemory = 4 << 20
+
+// coalesceChunkSize is how much of a shared download is read from its source at a time
+const coalesceChunkSize = 32 * 1024
+
+// WithCoalescing shares one fetch between callers asking for the same file at the same time. Each caller gets
+// its own reader over a copy of the download, kept in memory up to maxMemory bytes and spooled to a temporary
+// file past that. Callers keep joining a download for as long as one of its readers is open. Under RemoteOnly
+// nothing touches the disk: callers stop joining a download once maxMemory of it has been read, only the last
+// maxMemory bytes are kept, and a reader that falls further behind than that fails.
+// A shared fetch is not bound to any one caller's context, it is cancelled once every caller has gone.
+// Seekable fetches are never shared.
+func WithCoalescing(maxMemory int64) Option {
+	return func(g *Getter) {
+		g.flights = &flights{inFlight: map[flightKey]*flight{}, maxMemory: maxMemory}
+	}
+}
+
+// flightKey identifies the fetches that can share a download
+type flightKey struct {
+	localPath, host, bucket, key, url string
+	// sources is the request's Sources joined by commas
+	sources  string
+	hasRange bool
+	rng      ByteRange
+}
+
+// newFlightKey returns the key of req. Checksums are checked by each reader, so they do not split downloads.
+func newFlightKey(req FetchRequest) flightKey {
+	k := flightKey{localPath: req.LocalPath, host: req.Host, bucket: req.Bucket, key: req.Key, url: req.URL}
+	for i, s := range req.Sources {
+		if i > 0 {
+			k.sources += ","
+		}
+		k.sources += string(s)
+	}
+	if req.Range != nil {
+		k.hasRange, k.rng = true, *req.Range
+	}
+	return k
+}
+
+// flights tracks the downloads that can be joined
+type flights struct {
+	mu        sync.Mutex
+	inFlight  map[flightKey]*flight
+	maxMemory int64
+}
+
+// flight is a fetch shared by every caller that joined it. Lock order is flights.mu then flight.mu.
+type flight struct {
+	key     flightKey
+	flights *flights
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// ready is closed once the fetch has returned
+	ready chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// refs counts the callers waiting for the fetch and the readers that are open
+	refs int
+	// fetched is set along with res and err once the fetch has returned
+	fetched bool
+	res     *FetchResult
+	err     error
+
+	spool *spool
+	chunk []byte
+	// pulling is set while a pull is reading from the source
+	pulling bool
+	// done is set along with readErr once the source has been read to the end or failed
+	done    bool
+	readErr error
+}
+
+// fetchShared is fetch, sharing the download with other callers when coalescing is on
+func (g *Getter) fetchShared(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	if g.flights == nil {
+		return g.fetch(ctx, req)
+	}
+
+	f, leader := g.flights.join(newFlightKey(req), g.strategy == RemoteOnly)
+	if leader {
+		go f.run(g, req)
+	}
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		f.release()
+		return &FetchResult{}, ctx.Err()
+	}
+	if f.err != nil {
+		f.release()
+		return &FetchResult{Source: f.res.Source}, f.err
+	}
+
+	res := *f.res
+	res.Body = &sharedReader{f: f}
+	res.Metadata = copyMetadata(f.res.Metadata)
+	return &res, nil
+}
+
+// join returns the flight for key, taking a reference to it. leader is true if the flight is new and
+// the caller must run it. memoryOnly keeps a new flight's download off the disk.
+func (fl *flights) join(key flightKey, memoryOnly bool) (f *flight, leader bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	if f, ok := fl.inFlight[key]; ok {
+		f.mu.Lock()
+		failed := (f.fetched && f.err != nil) || (f.done && f.readErr != io.EOF)
+		if !failed && !f.spool.trimmed() {
+			f.refs++
+			f.mu.Unlock()
+			return f, false
+		}
+		// whoever joins now should get a fresh attempt instead of the old failure, or of a download
+		// whose start is gone
+		f.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f = &flight{
+		key:     key,
+		flights: fl,
+		ctx:     ctx,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+		refs:    1,
+		spool:   &spool{maxMemory: fl.maxMemory, memoryOnly: memoryOnly},
+	}
+	f.cond = sync.NewCond(&f.mu)
+	fl.inFlight[key] = f
+	return f, true
+}
+
+// run does the fetch everyone in the flight is waiting for
+func (f *flight) run(g *Getter, req FetchRequest) {
+	res, err := g.fetch(f.ctx, req)
+
+	f.mu.Lock()
+	f.fetched, f.res, f.err = true, res, err
+	abandoned := f.refs == 0
+	f.mu.Unlock()
+	close(f.ready)
+
+	if abandoned && err == nil {
+		// everyone gave up while we were fetching
+		res.Body.Close()
+	}
+}
+
+// release drops a reference to the flight, closing the download when it was the last one
+func (f *flight) release() error {
+	f.flights.mu.Lock()
+	f.mu.Lock()
+	f.refs--
+	last := f.refs == 0
+	if last && f.flights.inFlight[f.key] == f {
+		delete(f.flights.inFlight, f.key)
+	}
+	fetched := f.fetched
+	f.mu.Unlock()
+	f.flights.mu.Unlock()
+
+	if !last {
+		return nil
+	}
+	f.cancel()
+	if !fetched || f.err != nil {
+		// run cleans up a fetch that finishes after everyone has gone
+		return nil
+	}
+	err := f.res.Body.Close()
+	f.mu.Lock()
+	// a pull still reading from the source may be about to write to the spool
+	f.spool.close()
+	f.mu.Unlock()
+	return err
+}
+
+// sharedReader is one caller's reader over a flight's download
+type sharedReader struct {
+	f   *flight
+	off int64
+	// closed is guarded by f.mu
+	closed bool
+}
+
+// Read returns the next part of the download, waiting for more of it to be read from the source when this
+// reader is the furthest along. The source is read by the flight, so closing this reader, as its context
+// ending does, stops the wait without holding up the other readers.
+func (r *sharedReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		switch {
+		case r.closed:
+			return 0, errors.New("read of closed file")
+		case r.off < f.spool.size:
+			n, err := f.spool.readAt(p, r.off)
+			r.off += int64(n)
+			return n, err
+		case f.done:
+			return 0, f.readErr
+		case !f.pulling:
+			f.pulling = true
+			go f.pull()
+		}
+		f.cond.Wait()
+	}
+}
+
+// pull reads the next chunk of the download from the source into the spool, waking the readers waiting
+// for it. f.pulling must be set, only one pull runs at a time.
+func (f *flight) pull() {
+	if f.chunk == nil {
+		f.chunk = make([]byte, f.spool.chunkSize())
+	}
+	n, err := f.res.Body.Read(f.chunk)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulling = false
+	if n > 0 {
+		if werr := f.spool.write(f.chunk[:n]); werr != nil {
+			err = errors.Wrap(werr, "unable to spool shared download")
+		}
+	}
+	if err != nil {
+		f.done, f.readErr = true, err
+	}
+	f.cond.Broadcast()
+}
+
+// Close closes this reader, and the download once every reader is closed
+func (r *sharedReader) Close() error {
+	r.f.mu.Lock()
+	if r.closed {
+		r.f.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.f.cond.Broadcast()
+	r.f.mu.Unlock()
+	return r.f.release()
+}
+
+// spool holds a download in memory, moving it to a temporary file once it grows past maxMemory. A memoryOnly
+// spool drops the start of the download instead, keeping only the last maxMemory bytes.
+type spool struct {
+	maxMemory  int64
+	memoryOnly bool
+	buf        []byte
+	file       *os.File
+	size       int64
+	// base is the offset of buf in the download, past zero once a memoryOnly spool has dropped data
+	base   int64
+	closed bool
+}
+
+// write appends p to the spool
+func (s *spool) write(p []byte) error {
+	if s.closed {
+		return errors.New("spool is closed")
+	}
+	if s.file == nil && !s.memoryOnly && s.size+int64(len(p)) > s.maxMemory {
+		file, err := ioutil.TempFile("", "getter-spool-")
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(s.buf); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		s.file, s.buf = file, nil
+	}
+
+	if s.file != nil {
+		if _, err := s.file.WriteAt(p, s.size); err != nil {
+			return err
+		}
+	} else {
+		s.buf = append(s.buf, p...)
+	}
+	s.size += int64(len(p))
+	if s.memoryOnly && s.size-s.base > s.window() {
+		drop := s.size - s.base - s.window()
+		s.buf, s.base = s.buf[drop:], s.base+drop
+	}
+	return nil
+}
+
+// window is how much of the download a memoryOnly spool keeps
+func (s *spool) window() int64 {
+	if s.maxMemory < 1 {
+		return 1
+	}
+	return s.maxMemory
+}
+
+// chunkSize is how much to read from the source at a time. A memoryOnly spool never reads more than it keeps,
+// so the reader waiting on a chunk can always read it.
+func (s *spool) chunkSize() int {
+	if s.memoryOnly && s.window() < coalesceChunkSize {
+		return int(s.window())
+	}
+	return coalesceChunkSize
+}
+
+// trimmed reports whether the spool has dropped the start of the download
+func (s *spool) trimmed() bool {
+	return s.base > 0
+}
+
+// readAt reads what has been spooled at off
+func (s *spool) readAt(p []byte, off int64) (int, error) {
+	if off < s.base {
+		return 0, errors.Errorf("shared download is more than %d bytes ahead of this reader and no longer holds offset %d, "+
+			"see WithCoalescing", s.window(), off)
+	}
+	if int64(len(p)) > s.size-off {
+		p = p[:s.size-off]
+	}
+	if s.file != nil {
+		return s.file.ReadAt(p, off)
+	}
+	return copy(p, s.buf[off-s.base:]), nil
+}
+
+// close throws the spool away
+func (s *spool) close() {
+	s.closed = true
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+	s.buf = nil
+}
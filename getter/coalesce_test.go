@@ -0,0 +1,356 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedRemote holds every fetch until release is closed, then serves data
+type gatedRemote struct {
+	data    []byte
+	err     error
+	release chan struct{}
+	calls   int32
+	closes  int32
+	// cancelled counts the fetches that gave up because their context was done
+	cancelled int32
+}
+
+func newGatedRemote(data []byte, err error) *gatedRemote {
+	return &gatedRemote{data: data, err: err, release: make(chan struct{})}
+}
+
+func (f *gatedRemote) Name() string {
+	return string(Remote)
+}
+
+func (f *gatedRemote) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	atomic.AddInt32(&f.calls, 1)
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		atomic.AddInt32(&f.cancelled, 1)
+		return nil, ObjectInfo{}, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, ObjectInfo{}, f.err
+	}
+	body := &closeCounter{Reader: bytes.NewReader(f.data), closes: &f.closes}
+	return body, ObjectInfo{Size: int64(len(f.data)), Metadata: map[string]string{"Mail-Id": "42"}}, nil
+}
+
+func (f *gatedRemote) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(f.data))}, f.err
+}
+
+// closeCounter counts how many times it is closed
+type closeCounter struct {
+	io.Reader
+	closes *int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(c.closes, 1)
+	return nil
+}
+
+// waitForRefs waits until n callers have joined the flight for req
+func waitForRefs(t *testing.T, g *Getter, req FetchRequest, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.flights.mu.Lock()
+		f := g.flights.inFlight[newFlightKey(req)]
+		g.flights.mu.Unlock()
+		if f != nil {
+			f.mu.Lock()
+			refs := f.refs
+			f.mu.Unlock()
+			if refs == n {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d callers never joined", n)
+}
+
+// TestFetchCoalescing verifies that concurrent fetches of the same file share one download, each getting all of it
+func TestFetchCoalescing(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		maxMemory int64
+	}{
+		{name: "in memory", maxMemory: DefaultCoalesceMemory},
+		{name: "spooled", maxMemory: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := []byte(strings.Repeat("0123456789", 10000))
+			remote := newGatedRemote(data, nil)
+			fetcher := New(discardLogger(), true, "key", "secret", WithCoalescing(test.maxMemory))
+			fetcher.remote = remote
+			fetcher.local = &fakeLocal{err: assert.AnError}
+			req := FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}
+
+			const callers = 5
+			var wg sync.WaitGroup
+			bodies := make([][]byte, callers)
+			results := make([]*FetchResult, callers)
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					res, err := fetcher.FetchObject(context.Background(), req)
+					if !assert.NoError(t, err) {
+						return
+					}
+					defer res.Body.Close()
+					results[i] = res
+					// readers take small bites at different rates
+					buf := make([]byte, 1000+i*777)
+					var out bytes.Buffer
+					_, err = io.CopyBuffer(&out, struct{ io.Reader }{res.Body}, buf)
+					assert.NoError(t, err)
+					bodies[i] = out.Bytes()
+				}(i)
+			}
+			waitForRefs(t, fetcher, req, callers)
+			close(remote.release)
+			wg.Wait()
+
+			assert.Equal(t, int32(1), atomic.LoadInt32(&remote.calls))
+			assert.Equal(t, int32(1), atomic.LoadInt32(&remote.closes))
+			for i := range bodies {
+				assert.Equal(t, data, bodies[i], "caller %d", i)
+				assert.Equal(t, Remote, results[i].Source)
+				assert.Equal(t, int64(len(data)), results[i].Size)
+			}
+			results[0].Metadata["Mail-Id"] = "changed"
+			assert.Equal(t, "42", results[1].Metadata["Mail-Id"], "callers get their own copy of the info")
+			assert.Empty(t, fetcher.flights.inFlight)
+
+			// the download is gone, the next fetch starts another
+			fh, _, err := fetcher.Fetch(context.Background(), req)
+			require.NoError(t, err)
+			fh.Close()
+			assert.Equal(t, int32(2), atomic.LoadInt32(&remote.calls))
+		})
+	}
+}
+
+// TestFetchCoalescingRemoteOnly verifies that a RemoteOnly download keeps at most maxMemory bytes, stops taking
+// new callers once it has dropped data, and fails readers that fall too far behind
+func TestFetchCoalescingRemoteOnly(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 1000))
+	remote := newGatedRemote(data, nil)
+	fetcher := New(discardLogger(), true, "key", "secret", WithStrategy(RemoteOnly), WithCoalescing(100))
+	fetcher.remote = remote
+	req := FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}
+
+	results := make(chan *FetchResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			res, err := fetcher.FetchObject(context.Background(), req)
+			assert.NoError(t, err)
+			results <- res
+		}()
+	}
+	waitForRefs(t, fetcher, req, 2)
+	close(remote.release)
+	fast, slow := <-results, <-results
+	defer slow.Body.Close()
+
+	head := make([]byte, 50)
+	_, err := io.ReadFull(slow.Body, head)
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadAll(fast.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+	f := fast.Body.(*sharedReader).f
+	f.mu.Lock()
+	assert.Len(t, f.spool.buf, 100, "only the last maxMemory bytes are kept")
+	f.mu.Unlock()
+
+	// a caller arriving now cannot be given the start of the download, so it gets a download of its own
+	fh, _, err := fetcher.Fetch(context.Background(), req)
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(fh)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+	fh.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&remote.calls))
+	fast.Body.Close()
+
+	_, err = slow.Body.Read(head)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no longer holds offset 50")
+	_, err = slow.Body.Read(head)
+	assert.Error(t, err, "the failure sticks")
+}
+
+// TestFetchCoalescingClose verifies that the shared download is only closed once every reader is closed
+func TestFetchCoalescingClose(t *testing.T) {
+	data := []byte("file data")
+	remote := newGatedRemote(data, nil)
+	close(remote.release)
+	fetcher := New(discardLogger(), true, "key", "secret", WithCoalescing(DefaultCoalesceMemory))
+	fetcher.remote = remote
+	req := FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}
+
+	first, _, err := fetcher.Fetch(context.Background(), req)
+	require.NoError(t, err)
+	second, _, err := fetcher.Fetch(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&remote.calls), "later callers join while a reader is open")
+
+	_, err = first.Read(make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close(), "closing twice is harmless")
+	_, err = first.Read(make([]byte, 4))
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&remote.closes))
+
+	body, err := ioutil.ReadAll(second)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+	require.NoError(t, second.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&remote.closes))
+}
+
+// TestFetchCoalescingErrors verifies that a failed fetch is reported to everyone waiting on it, and that callers
+// can give up waiting
+func TestFetchCoalescingErrors(t *testing.T) {
+	remote := newGatedRemote(nil, errNoSuchKey)
+	fetcher := New(discardLogger(), true, "key", "secret", WithCoalescing(DefaultCoalesceMemory))
+	fetcher.remote = remote
+	fetcher.local = &fakeLocal{err: assert.AnError}
+	req := FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			ctx := ctx
+			if i > 0 {
+				ctx = context.Background()
+			}
+			_, _, err := fetcher.Fetch(ctx, req)
+			errs <- err
+		}(i)
+	}
+	waitForRefs(t, fetcher, req, 3)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs, "the cancelled caller leaves on its own")
+
+	close(remote.release)
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		var fetchErr *FetchError
+		require.True(t, errors.As(err, &fetchErr), "got %v", err)
+		assert.Equal(t, Local, fetchErr.Source)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&remote.calls))
+
+	// a fetch that everyone gave up on is cancelled
+	abandoned := newGatedRemote([]byte("file data"), nil)
+	fetcher.remote = abandoned
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := fetcher.Fetch(ctx, req)
+		done <- err
+	}()
+	waitForRefs(t, fetcher, req, 1)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	fetcher.flights.mu.Lock()
+	assert.Empty(t, fetcher.flights.inFlight)
+	fetcher.flights.mu.Unlock()
+}
+
+// stalledRemote serves bodies that never return data, their reads only ending with the fetch's context
+type stalledRemote struct{}
+
+func (stalledRemote) Name() string {
+	return string(Remote)
+}
+
+func (stalledRemote) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	return ioutil.NopCloser(stalledBody{ctx: ctx}), ObjectInfo{Size: -1}, nil
+}
+
+func (stalledRemote) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: -1}, nil
+}
+
+// stalledBody blocks every read until ctx is done
+type stalledBody struct {
+	ctx context.Context
+}
+
+func (b stalledBody) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+// TestFetchCoalescingCancelledRead verifies that a caller whose context ends while it waits on the source
+// stops reading at once, even though another caller keeps the download going
+func TestFetchCoalescingCancelledRead(t *testing.T) {
+	fetcher := New(discardLogger(), true, "key", "secret", WithStrategy(RemoteOnly), WithCoalescing(DefaultCoalesceMemory),
+		WithRemoteBackend(stalledRemote{}))
+	req := FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}
+
+	other, _, err := fetcher.Fetch(context.Background(), req)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	fh, _, err := fetcher.Fetch(ctx, req)
+	require.NoError(t, err)
+	defer fh.Close()
+
+	otherRead := make(chan error, 1)
+	go func() {
+		_, err := other.Read(make([]byte, 4))
+		otherRead <- err
+	}()
+	read := make(chan error, 1)
+	go func() {
+		_, err := fh.Read(make([]byte, 4))
+		read <- err
+	}()
+	waitFor(t, func() bool {
+		fetcher.flights.mu.Lock()
+		f := fetcher.flights.inFlight[newFlightKey(req)]
+		fetcher.flights.mu.Unlock()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.pulling
+	}, "nobody read from the source")
+
+	cancel()
+	select {
+	case err := <-read:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled read is stuck behind the source")
+	}
+	select {
+	case err := <-otherRead:
+		t.Fatalf("the other caller's read returned with %v", err)
+	default:
+	}
+
+	require.NoError(t, other.Close())
+	assert.Error(t, <-otherRead, "closing the last reader ends the download")
+}
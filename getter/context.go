@@ -0,0 +1,102 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// contextReader ties an io.ReadCloser to a context. Once the context is done the underlying
+// ReadCloser is closed, unblocking any Read in progress, and every later Read returns ctx.Err().
+type contextReader struct {
+	ctx  context.Context
+	rc   io.ReadCloser
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+	stopOnce  sync.Once
+}
+
+// newContextReader wraps rc so that it honours ctx. A context that can never be cancelled
+// gets rc back untouched.
+func newContextReader(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return rc
+	}
+
+	r := &contextReader{ctx: ctx, rc: rc, done: make(chan struct{})}
+	go r.watch()
+	return r
+}
+
+// watch closes the underlying reader when the context ends before the caller closes it
+func (r *contextReader) watch() {
+	select {
+	case <-r.ctx.Done():
+		r.closeUnderlying()
+	case <-r.done:
+	}
+}
+
+// Read reads from the underlying reader, reporting ctx.Err() once the context is done
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.rc.Read(p)
+	if ctxErr := r.ctx.Err(); ctxErr != nil && err != nil && err != io.EOF {
+		// the read failed because we closed the reader out from under it
+		return n, ctxErr
+	}
+	return n, err
+}
+
+// Close stops watching the context and closes the underlying reader
+func (r *contextReader) Close() error {
+	r.stopOnce.Do(func() { close(r.done) })
+	return r.closeUnderlying()
+}
+
+func (r *contextReader) closeUnderlying() error {
+	r.closeOnce.Do(func() { r.closeErr = r.rc.Close() })
+	return r.closeErr
+}
+
+// contextReadSeeker is a contextReader that can also seek and read at offsets
+type contextReadSeeker struct {
+	*contextReader
+	rs ReadSeekCloser
+}
+
+// newContextReadSeeker wraps rs so that it honours ctx
+func newContextReadSeeker(ctx context.Context, rs ReadSeekCloser) ReadSeekCloser {
+	if ctx.Done() == nil {
+		return rs
+	}
+
+	r := &contextReadSeeker{contextReader: newContextReader(ctx, rs).(*contextReader), rs: rs}
+	return r
+}
+
+// Seek sets the offset of the next Read
+func (r *contextReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rs.Seek(offset, whence)
+}
+
+// ReadAt reads len(p) bytes starting at off, reporting ctx.Err() once the context is done
+func (r *contextReadSeeker) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.rs.ReadAt(p, off)
+	if ctxErr := r.ctx.Err(); ctxErr != nil && err != nil && err != io.EOF {
+		return n, ctxErr
+	}
+	return n, err
+}
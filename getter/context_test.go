@@ -0,0 +1,75 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestContextReaderCancelInFlight verifies that cancelling the context unblocks a Read that is waiting on data
+func TestContextReaderCancelInFlight(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newContextReader(ctx, pr)
+	defer r.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 8))
+		errc <- err
+	}()
+
+	// give the read a moment to block on the pipe before cancelling
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("read was not interrupted by context cancellation")
+	}
+
+	_, err := r.Read(make([]byte, 8))
+	assert.Equal(t, context.Canceled, err)
+}
+
+// TestContextReaderDeadline verifies that reads report the deadline once it has passed
+func TestContextReaderDeadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("file data"), 0600))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	fh, _, err := (&osFile{}).Fetch(ctx, FetchRequest{LocalPath: path})
+	require.NoError(t, err)
+	r := newContextReader(ctx, fh)
+	defer r.Close()
+
+	<-ctx.Done()
+	_, err = r.Read(make([]byte, 8))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	_, _, err = (&osFile{}).Fetch(ctx, FetchRequest{LocalPath: path})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// TestContextReaderBackground verifies that an uncancellable context leaves the reader alone
+func TestContextReaderBackground(t *testing.T) {
+	rc := ioutil.NopCloser(nil)
+	assert.Equal(t, rc, newContextReader(context.Background(), rc))
+}
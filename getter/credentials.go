@@ -0,0 +1,65 @@
+package getter
+
+import (
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// expiredCredentialCodes are remote error codes telling us the credentials we signed with are stale
+var expiredCredentialCodes = map[string]bool{
+	"ExpiredToken":         true,
+	"InvalidToken":         true,
+	"TokenRefreshRequired": true,
+	"InvalidAccessKeyId":   true,
+}
+
+// WithCredentials replaces the static accessKey and accessSecret given to New with creds.
+// creds is asked for a fresh value whenever the current one has expired, so rotating providers
+// such as NewCredentialsChain keep working for the life of the Getter.
+func WithCredentials(creds *credentials.Credentials) Option {
+	return func(g *Getter) {
+		g.creds = creds
+	}
+}
+
+// NewCredentialsChain returns credentials that are looked up, in order, from
+//   - the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY environment variables
+//   - the MINIO_ACCESS_KEY/MINIO_SECRET_KEY environment variables
+//   - the AWS shared credentials file (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials)
+//   - the minio client config file (~/.mc/config.json)
+//   - the IAM style metadata endpoint at iamEndpoint, the EC2 default when empty
+//
+// The first provider with keys wins. Keys from the metadata endpoint are refreshed once they expire.
+func NewCredentialsChain(iamEndpoint string) *credentials.Credentials {
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.FileMinioClient{},
+		&credentialsProvider{creds: credentials.NewIAM(iamEndpoint)},
+	})
+}
+
+// credentialsProvider lets a *credentials.Credentials take part in a chain as a Provider.
+// NewIAM is the only way to point the IAM provider at a custom endpoint and it hands back Credentials.
+type credentialsProvider struct {
+	creds *credentials.Credentials
+}
+
+// Retrieve returns the current value of the wrapped credentials, refreshing them if needed
+func (p *credentialsProvider) Retrieve() (credentials.Value, error) {
+	return p.creds.Get()
+}
+
+// IsExpired reports whether the wrapped credentials need a refresh
+func (p *credentialsProvider) IsExpired() bool {
+	return p.creds.IsExpired()
+}
+
+// expireOnAuthError forces creds to be retrieved again when err says they are no longer accepted
+func expireOnAuthError(creds *credentials.Credentials, err error) {
+	if expiredCredentialCodes[minio.ToErrorResponse(errors.Cause(err)).Code] {
+		creds.Expire()
+	}
+}
@@ -0,0 +1,156 @@
+package getter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIAM stands in for an IAM metadata endpoint. Every retrieval hands out a new access key,
+// expiring after the lifetime returned by expiresIn.
+type fakeIAM struct {
+	*httptest.Server
+	retrievals int64
+	expiresIn  func() time.Duration
+}
+
+func newFakeIAM(expiresIn func() time.Duration) *fakeIAM {
+	f := &fakeIAM{expiresIn: expiresIn}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "mail-reader")
+	})
+	mux.HandleFunc("/latest/meta-data/iam/security-credentials/mail-reader", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&f.retrievals, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Code":            "Success",
+			"AccessKeyId":     fmt.Sprintf("iam-%d", n),
+			"SecretAccessKey": "iam-secret",
+			"Token":           "iam-token",
+			"Expiration":      time.Now().Add(f.expiresIn()).UTC(),
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// clearCredentialEnv points every environment and file based provider at nothing for the length of a test
+func clearCredentialEnv(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+
+	vars := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_ACCESS_KEY":              "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SECRET_KEY":              "",
+		"MINIO_ACCESS_KEY":            "",
+		"MINIO_SECRET_KEY":            "",
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing"),
+	}
+	old := map[string]string{}
+	for k, v := range vars {
+		old[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			os.Setenv(k, v)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// TestCredentialsChainEnv verifies that environment variables take precedence over the metadata endpoint
+func TestCredentialsChainEnv(t *testing.T) {
+	defer clearCredentialEnv(t)()
+	iam := newFakeIAM(func() time.Duration { return time.Hour })
+	defer iam.Close()
+
+	os.Setenv("MINIO_ACCESS_KEY", "env-key")
+	os.Setenv("MINIO_SECRET_KEY", "env-secret")
+
+	value, err := NewCredentialsChain(iam.URL).Get()
+	require.NoError(t, err)
+	assert.Equal(t, "env-key", value.AccessKeyID)
+	assert.Equal(t, "env-secret", value.SecretAccessKey)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&iam.retrievals))
+}
+
+// TestCredentialsChainIAMRefresh verifies that expired keys from the metadata endpoint are refreshed between fetches
+func TestCredentialsChainIAMRefresh(t *testing.T) {
+	defer clearCredentialEnv(t)()
+
+	lifetime := int64(time.Second)
+	iam := newFakeIAM(func() time.Duration { return time.Duration(atomic.LoadInt64(&lifetime)) })
+	defer iam.Close()
+
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "key", []byte("file data"))
+
+	fetcher := New(discardLogger(), true, "", "", WithCredentials(NewCredentialsChain(iam.URL)))
+	fetch := func() {
+		fh, source, err := fetcher.FetchFile("", s3.Host(), "bucket", "key")
+		require.NoError(t, err)
+		assert.Equal(t, Remote, source)
+		fh.Close()
+	}
+
+	// a one second lifetime is inside the expiry window, so every fetch asks for new keys
+	fetch()
+	fetch()
+	atomic.StoreInt64(&lifetime, int64(time.Hour))
+	fetch()
+	fetch()
+
+	keys := s3.signedWith()
+	require.Len(t, keys, 4)
+	assert.NotEqual(t, keys[0], keys[1], "short lived keys should be refreshed")
+	assert.NotEqual(t, keys[1], keys[2], "short lived keys should be refreshed")
+	assert.Equal(t, keys[2], keys[3], "long lived keys should be reused")
+}
+
+// countingProvider counts how often credentials are retrieved
+type countingProvider struct {
+	retrievals int
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrievals++
+	return credentials.Value{AccessKeyID: "key", SecretAccessKey: "secret"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return false
+}
+
+// TestExpireOnAuthError verifies that only errors about stale credentials force a refresh
+func TestExpireOnAuthError(t *testing.T) {
+	provider := &countingProvider{}
+	creds := credentials.New(provider)
+	_, err := creds.Get()
+	require.NoError(t, err)
+
+	expireOnAuthError(creds, minio.ErrorResponse{Code: "NoSuchKey"})
+	_, err = creds.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.retrievals)
+
+	expireOnAuthError(creds, minio.ErrorResponse{Code: "ExpiredToken"})
+	_, err = creds.Get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, provider.retrievals)
+}
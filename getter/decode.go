@@ -0,0 +1,188 @@
+package getter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Encoding allows us to have a type safe value naming how a file's content is compressed
+type Encoding string
+
+const (
+	// EncodingIdentity is content that is not compressed
+	EncodingIdentity Encoding = "identity"
+	// EncodingGzip is gzip compressed content
+	EncodingGzip Encoding = "gzip"
+	// EncodingZlib is zlib compressed content, the deflate Content-Encoding of HTTP
+	EncodingZlib Encoding = "zlib"
+	// EncodingBzip2 is bzip2 compressed content
+	EncodingBzip2 Encoding = "bzip2"
+)
+
+// contentEncodings maps Content-Encoding values onto the encodings they name
+var contentEncodings = map[string]Encoding{
+	"identity": EncodingIdentity,
+	"gzip":     EncodingGzip,
+	"x-gzip":   EncodingGzip,
+	"deflate":  EncodingZlib,
+	"bzip2":    EncodingBzip2,
+	"x-bzip2":  EncodingBzip2,
+}
+
+// extensionEncodings maps file name extensions onto the encodings they name
+var extensionEncodings = map[string]Encoding{
+	".gz":   EncodingGzip,
+	".gzip": EncodingGzip,
+	".zz":   EncodingZlib,
+	".zlib": EncodingZlib,
+	".bz2":  EncodingBzip2,
+}
+
+// WithDecompression decompresses gzip, zlib and bzip2 files as they are read. The encoding is taken from the
+// file's Content-Encoding, then the extension of its name, then the first bytes of its content. Ranges are
+// returned as stored since they cannot be decompressed on their own. Decompressed results have a Size of -1.
+func WithDecompression() Option {
+	return func(g *Getter) {
+		g.decompress = true
+	}
+}
+
+// decode decompresses res.Body when decompression is on, reporting the encodings on res.
+// Errors are from reading the start of the body, which has been closed.
+func (g *Getter) decode(req FetchRequest, res *FetchResult) error {
+	if !g.decompress {
+		return nil
+	}
+	if req.Range != nil {
+		res.OriginalEncoding = encodingFromHeader(res.ContentEncoding)
+		res.DecodedEncoding = res.OriginalEncoding
+		return nil
+	}
+
+	body := bufio.NewReader(res.Body)
+	encoding := encodingFromHeader(res.ContentEncoding)
+	if encoding == EncodingIdentity && res.ContentEncoding == "" {
+		encoding = encodingFromName(decodeName(req, res.Source))
+	}
+	if encoding == EncodingIdentity && res.ContentEncoding == "" {
+		encoding = sniffEncoding(body)
+	}
+	res.OriginalEncoding, res.DecodedEncoding = encoding, encoding
+
+	decoded, err := newDecoder(encoding, body)
+	if err != nil {
+		res.Body.Close()
+		return errors.Wrapf(err, "unable to decode %s content", encoding)
+	}
+	if decoded == nil {
+		res.Body = readCloser{Reader: body, Closer: res.Body}
+		return nil
+	}
+	res.Body = &decodedReader{ReadCloser: decoded, body: res.Body}
+	res.DecodedEncoding = EncodingIdentity
+	res.Size = -1
+	return nil
+}
+
+// encodingFromHeader returns the encoding a Content-Encoding names. Values that are not understood are
+// reported as they are, and left alone.
+func encodingFromHeader(contentEncoding string) Encoding {
+	value := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if value == "" {
+		return EncodingIdentity
+	}
+	if encoding, ok := contentEncodings[value]; ok {
+		return encoding
+	}
+	return Encoding(value)
+}
+
+// encodingFromName returns the encoding the extension of name implies
+func encodingFromName(name string) Encoding {
+	if encoding, ok := extensionEncodings[strings.ToLower(path.Ext(name))]; ok {
+		return encoding
+	}
+	return EncodingIdentity
+}
+
+// decodeName returns the name of the file req asks source for
+func decodeName(req FetchRequest, source Source) string {
+	switch {
+	case source == Local:
+		return req.LocalPath
+	case source == HTTP:
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return ""
+		}
+		if u.Fragment != "" {
+			// the member of an archive
+			return u.Fragment
+		}
+		return u.Path
+	case req.Key != "":
+		return req.Key
+	}
+	return req.LocalPath
+}
+
+// sniffEncoding recognises compressed content by its first bytes
+func sniffEncoding(body *bufio.Reader) Encoding {
+	magic, _ := body.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return EncodingGzip
+	case len(magic) == 4 && bytes.HasPrefix(magic, []byte("BZh")) && magic[3] >= '1' && magic[3] <= '9':
+		// the fourth byte is the block size in hundreds of kilobytes, so plain text starting BZh is not bzip2
+		return EncodingBzip2
+	case len(magic) >= 2 && magic[0] == 0x78 && (magic[1] == 0x01 || magic[1] == 0x5e || magic[1] == 0x9c || magic[1] == 0xda):
+		// deflate with a 32K window at each compression level, the only zlib headers seen in practice
+		return EncodingZlib
+	}
+	return EncodingIdentity
+}
+
+// newDecoder returns a reader decompressing r, nil for content that is not decompressed
+func newDecoder(encoding Encoding, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZlib:
+		return zlib.NewReader(r)
+	case EncodingBzip2:
+		return readCloser{Reader: bzip2.NewReader(r), Closer: nopCloser{}}, nil
+	}
+	return nil, nil
+}
+
+// nopCloser is a Closer that does nothing
+type nopCloser struct{}
+
+// Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+// decodedReader is decompressed content. Closing it closes the decompressor and the body it reads from.
+type decodedReader struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+// Close closes the decompressor and then the body, returning the first error
+func (d *decodedReader) Close() error {
+	err := d.ReadCloser.Close()
+	if bodyErr := d.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package getter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bzip2Mail is "Subject: bzip2\r\n\r\nbody" compressed with bzip2, which the standard library can only read
+const bzip2Mail = "425a6839314159265359cfec1fac000003db8000124000101008001e30c63020002220d0064fd48534c8c4c4c49a568ace16cb043a4042fc5dc914e142433fb07eb0"
+
+// closeCountingBackend counts how many of the bodies it hands out are closed
+type closeCountingBackend struct {
+	Backend
+	closes int32
+}
+
+func (b *closeCountingBackend) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	fh, info, err := b.Backend.Fetch(ctx, req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return readCloser{Reader: fh, Closer: &closeCounter{closes: &b.closes}}, info, nil
+}
+
+// TestFetchDecompressed verifies that compressed files are recognised by their Content-Encoding, name or
+// first bytes, decompressed, and report both encodings
+func TestFetchDecompressed(t *testing.T) {
+	mail := []byte("Subject: hello\r\n\r\nbody")
+	var gz, zz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(mail)
+	gw.Close()
+	zw := zlib.NewWriter(&zz)
+	zw.Write(mail)
+	zw.Close()
+	bz, err := hex.DecodeString(bzip2Mail)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name             string
+		key              string
+		data             []byte
+		contentEncoding  string
+		rng              *ByteRange
+		off              bool
+		expectedData     []byte
+		expectedOriginal Encoding
+		expectedDecoded  Encoding
+		expectedSize     int64
+		expectedErr      bool
+	}{
+		{name: "gzip extension", key: "mail.eml.gz", data: gz.Bytes(), expectedData: mail, expectedOriginal: EncodingGzip, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "bzip2 extension", key: "mail.eml.bz2", data: bz, expectedData: []byte("Subject: bzip2\r\n\r\nbody"), expectedOriginal: EncodingBzip2, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "deflate content encoding", key: "mail.eml", data: zz.Bytes(), contentEncoding: "deflate", expectedData: mail, expectedOriginal: EncodingZlib, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "gzip magic", key: "mail.eml", data: gz.Bytes(), expectedData: mail, expectedOriginal: EncodingGzip, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "zlib magic", key: "mail", data: zz.Bytes(), expectedData: mail, expectedOriginal: EncodingZlib, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "bzip2 magic", key: "mail", data: bz, expectedData: []byte("Subject: bzip2\r\n\r\nbody"), expectedOriginal: EncodingBzip2, expectedDecoded: EncodingIdentity, expectedSize: -1},
+		{name: "bzip2 magic without a block size", key: "mail", data: []byte("BZh? is plain text"), expectedData: []byte("BZh? is plain text"), expectedOriginal: EncodingIdentity, expectedDecoded: EncodingIdentity, expectedSize: 18},
+		{name: "plain", key: "mail.eml", data: mail, expectedData: mail, expectedOriginal: EncodingIdentity, expectedDecoded: EncodingIdentity, expectedSize: int64(len(mail))},
+		{name: "identity content encoding beats magic", key: "mail.gz", data: gz.Bytes(), contentEncoding: "identity", expectedData: gz.Bytes(), expectedOriginal: EncodingIdentity, expectedDecoded: EncodingIdentity, expectedSize: int64(gz.Len())},
+		{name: "unknown content encoding", key: "mail.eml", data: mail, contentEncoding: "br", expectedData: mail, expectedOriginal: "br", expectedDecoded: "br", expectedSize: int64(len(mail))},
+		{name: "range left alone", key: "mail.eml.gz", data: gz.Bytes(), rng: &ByteRange{Offset: 0, Length: 2}, expectedData: gz.Bytes()[:2], expectedOriginal: EncodingIdentity, expectedDecoded: EncodingIdentity, expectedSize: 2},
+		{name: "off", key: "mail.eml.gz", data: gz.Bytes(), off: true, expectedData: gz.Bytes(), expectedSize: int64(gz.Len())},
+		{name: "corrupt", key: "mail.eml.gz", data: mail, expectedErr: true},
+		{name: "empty", key: "mail.eml", data: []byte{}, expectedData: []byte{}, expectedOriginal: EncodingIdentity, expectedDecoded: EncodingIdentity},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mem := NewMemoryBackend("memory")
+			mem.Put("bucket/"+test.key, test.data, ObjectInfo{ContentEncoding: test.contentEncoding})
+			remote := &closeCountingBackend{Backend: mem}
+			opts := []Option{WithRemoteBackend(remote)}
+			if !test.off {
+				opts = append(opts, WithDecompression())
+			}
+
+			fetcher := New(discardLogger(), true, "key", "secret", opts...)
+			res, err := fetcher.FetchObject(context.Background(), FetchRequest{Host: "host", Bucket: "bucket", Key: test.key, Range: test.rng})
+			if test.expectedErr {
+				assert.Error(t, err)
+				assert.Equal(t, int32(1), atomic.LoadInt32(&remote.closes), "the body is closed")
+				return
+			}
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, body)
+			assert.Equal(t, test.expectedOriginal, res.OriginalEncoding)
+			assert.Equal(t, test.expectedDecoded, res.DecodedEncoding)
+			assert.Equal(t, test.expectedSize, res.Size)
+
+			assert.Equal(t, int32(0), atomic.LoadInt32(&remote.closes))
+			require.NoError(t, res.Body.Close())
+			assert.Equal(t, int32(1), atomic.LoadInt32(&remote.closes), "closing the result closes the body")
+		})
+	}
+}
+
+// TestEncodingFromName verifies which extensions imply an encoding
+func TestEncodingFromName(t *testing.T) {
+	for name, expected := range map[string]Encoding{
+		"mail.eml.gz":    EncodingGzip,
+		"MAIL.EML.GZ":    EncodingGzip,
+		"mail.gzip":      EncodingGzip,
+		"mail.zz":        EncodingZlib,
+		"dir/mail.bz2":   EncodingBzip2,
+		"mail.eml":       EncodingIdentity,
+		"archive.gz/eml": EncodingIdentity,
+		"":               EncodingIdentity,
+	} {
+		assert.Equal(t, expected, encodingFromName(name), name)
+	}
+}
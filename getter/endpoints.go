@@ -0,0 +1,161 @@
+package getter
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Endpoint is a remote file system host serving a bucket
+type Endpoint struct {
+	Host string
+	// Weight is the endpoint's share of the fetches it is tried first for when endpoints are weighted.
+	// Weights below 1 count as 1.
+	Weight int
+}
+
+// EndpointList is the set of endpoints serving a bucket, for replicated object stores
+type EndpointList struct {
+	Endpoints []Endpoint
+	// Weighted picks the order endpoints are tried in at random for each fetch, favouring heavier endpoints.
+	// Otherwise endpoints are always tried in the order they are listed.
+	Weighted bool
+}
+
+// WithEndpoints fetches files in bucket from the endpoints of list, failing over from one to the next before
+// falling back to the local file. Requests for bucket may leave Host empty. A request that names a host not in
+// list has it tried first. The host that served a file is reported in FetchResult.Host.
+func WithEndpoints(bucket string, list EndpointList) Option {
+	return func(g *Getter) {
+		if g.endpoints == nil {
+			g.endpoints = map[string]EndpointList{}
+		}
+		g.endpoints[bucket] = list
+	}
+}
+
+// hasRemote reports whether req has a complete and well formed remote location, either by itself or through the
+// endpoints of its bucket
+func (g *Getter) hasRemote(req FetchRequest) bool {
+	if req.remoteErr() != nil {
+		return false
+	}
+	return req.hasRemote() || (req.Bucket != "" && req.Key != "" && len(g.endpoints[req.Bucket].Endpoints) > 0)
+}
+
+// validate is req.Validate, allowing for requests that leave their host to the endpoints of their bucket
+func (g *Getter) validate(req FetchRequest) error {
+	if endpoints := g.endpoints[req.Bucket].Endpoints; req.Host == "" && len(endpoints) > 0 {
+		req.Host = endpoints[0].Host
+	}
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if err := g.checkSources(req); err != nil {
+		return invalidRequestError(req, err)
+	}
+	return nil
+}
+
+// hosts returns the hosts to try for req, in order
+func (g *Getter) hosts(req FetchRequest) []string {
+	list := g.endpoints[req.Bucket]
+	var hosts []string
+	if req.Host != "" {
+		hosts = append(hosts, req.Host)
+	}
+
+	endpoints := list.Endpoints
+	if list.Weighted {
+		endpoints = weightedOrder(endpoints, g.random)
+	}
+	for _, e := range endpoints {
+		if e.Host != req.Host {
+			hosts = append(hosts, e.Host)
+		}
+	}
+	return hosts
+}
+
+// weightedOrder shuffles endpoints so that each comes next with a probability in proportion to its weight
+func weightedOrder(endpoints []Endpoint, random func() float64) []Endpoint {
+	remaining := append([]Endpoint{}, endpoints...)
+	ordered := make([]Endpoint, 0, len(endpoints))
+	for len(remaining) > 0 {
+		total := 0
+		for _, e := range remaining {
+			total += weight(e)
+		}
+		pick := random() * float64(total)
+		i := 0
+		for ; i < len(remaining)-1; i++ {
+			pick -= float64(weight(remaining[i]))
+			if pick < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+// weight returns the weight of e, at least 1
+func weight(e Endpoint) int {
+	if e.Weight < 1 {
+		return 1
+	}
+	return e.Weight
+}
+
+// fetchRemoteEndpoints fetches req remotely from each of its hosts in turn until one serves it
+func (g *Getter) fetchRemoteEndpoints(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	hosts := g.hosts(req)
+	var err error
+	for i, host := range hosts {
+		attempt := req
+		attempt.Host = host
+
+		var res FetchResult
+		res.Body, res.ObjectInfo, res.Source, err = g.fetchRemoteCached(ctx, attempt)
+		if err == nil {
+			res.Host = host
+			return &res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i < len(hosts)-1 {
+			g.logger.Printf("failing over from endpoint %q to %q - %v", host, hosts[i+1], err)
+		}
+	}
+	if len(hosts) > 1 {
+		err = errors.Wrapf(err, "all %d endpoints failed, the last was %q", len(hosts), hosts[len(hosts)-1])
+	}
+	return nil, err
+}
+
+// statRemoteEndpoints is statRemote, failing over between the hosts of req like fetchRemoteEndpoints
+func (g *Getter) statRemoteEndpoints(ctx context.Context, req FetchRequest) (ObjectInfo, string, error) {
+	hosts := g.hosts(req)
+	var err error
+	for i, host := range hosts {
+		attempt := req
+		attempt.Host = host
+
+		var info ObjectInfo
+		if info, err = g.statRemote(ctx, attempt); err == nil {
+			return info, host, nil
+		}
+		if ctx.Err() != nil {
+			return ObjectInfo{}, "", err
+		}
+		if i < len(hosts)-1 {
+			g.logger.Printf("failing over from endpoint %q to %q - %v", host, hosts[i+1], err)
+		}
+	}
+	if len(hosts) > 1 {
+		err = errors.Wrapf(err, "all %d endpoints failed, the last was %q", len(hosts), hosts[len(hosts)-1])
+	}
+	return ObjectInfo{}, "", err
+}
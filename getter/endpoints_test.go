@@ -0,0 +1,113 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchEndpoints verifies that a bucket's endpoints are failed over in order, reporting the one that served the file
+func TestFetchEndpoints(t *testing.T) {
+	down := newFakeS3(t)
+	downHost := down.Host()
+	down.Close()
+	empty := newFakeS3(t)
+	defer empty.Close()
+	replica := newFakeS3(t)
+	defer replica.Close()
+	replica.Put("bucket", "mail.eml", []byte("file data"))
+
+	logBuf := &bytes.Buffer{}
+	list := EndpointList{Endpoints: []Endpoint{{Host: downHost}, {Host: empty.Host()}, {Host: replica.Host()}}}
+	fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "key", "secret", WithEndpoints("bucket", list))
+
+	res, err := fetcher.FetchObject(context.Background(), FetchRequest{Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err, "the host can be left to the endpoints")
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "file data", string(body))
+	assert.Equal(t, Remote, res.Source)
+	assert.Equal(t, replica.Host(), res.Host)
+	assert.Contains(t, logBuf.String(), "failing over from endpoint \""+downHost+"\" to \""+empty.Host()+"\"")
+	assert.Contains(t, logBuf.String(), "failing over from endpoint \""+empty.Host()+"\" to \""+replica.Host()+"\"")
+	assert.Equal(t, int64(1), empty.objectRequests, "a replica missing the file is failed over too")
+
+	// a host named by the request is tried first
+	other := newFakeS3(t)
+	defer other.Close()
+	other.Put("bucket", "mail.eml", []byte("other data"))
+	res, err = fetcher.FetchObject(context.Background(), FetchRequest{Host: other.Host(), Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, other.Host(), res.Host)
+
+	// buckets without endpoints still need a host
+	_, err = fetcher.FetchObject(context.Background(), FetchRequest{Bucket: "other", Key: "mail.eml"})
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "got %v", err)
+
+	// local results have no host
+	fetcher.local = &fakeLocal{data: []byte("local data")}
+	res, err = fetcher.FetchObject(context.Background(), FetchRequest{LocalPath: "localpath", Bucket: "bucket", Key: "missing.eml"})
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, Local, res.Source)
+	assert.Empty(t, res.Host)
+}
+
+// TestFetchEndpointsAllFail verifies that the last endpoint's error is reported once every endpoint has failed
+func TestFetchEndpointsAllFail(t *testing.T) {
+	first := newFakeS3(t)
+	defer first.Close()
+	second := newFakeS3(t)
+	defer second.Close()
+
+	list := EndpointList{Endpoints: []Endpoint{{Host: first.Host()}, {Host: second.Host()}}}
+	fetcher := New(discardLogger(), true, "key", "secret", WithEndpoints("bucket", list), WithStrategy(RemoteOnly))
+	_, _, err := fetcher.Fetch(context.Background(), FetchRequest{Bucket: "bucket", Key: "mail.eml"})
+	assert.True(t, errors.Is(err, ErrNotFound), "got %v", err)
+	assert.Contains(t, err.Error(), "all 2 endpoints failed")
+	assert.Equal(t, int64(1), first.objectRequests)
+	assert.Equal(t, int64(1), second.objectRequests)
+}
+
+// TestWeightedOrder verifies that weighted endpoints are tried first in proportion to their weight
+func TestWeightedOrder(t *testing.T) {
+	endpoints := []Endpoint{{Host: "a", Weight: 3}, {Host: "b", Weight: 1}, {Host: "c"}}
+	tests := []struct {
+		name     string
+		random   []float64
+		expected []string
+	}{
+		// a covers [0, 0.6) of a total weight of 5, b [0.6, 0.8), and c [0.8, 1)
+		{name: "heaviest first", random: []float64{0.1, 0.1}, expected: []string{"a", "b", "c"}},
+		{name: "middle first", random: []float64{0.7, 0.9}, expected: []string{"b", "c", "a"}},
+		{name: "lightest first", random: []float64{0.95, 0.5}, expected: []string{"c", "a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			random := test.random
+			ordered := weightedOrder(endpoints, func() float64 {
+				if len(random) == 0 {
+					return 0
+				}
+				r := random[0]
+				random = random[1:]
+				return r
+			})
+			var hosts []string
+			for _, e := range ordered {
+				hosts = append(hosts, e.Host)
+			}
+			assert.Equal(t, test.expected, hosts)
+		})
+	}
+	assert.Equal(t, []Endpoint{{Host: "a", Weight: 3}, {Host: "b", Weight: 1}, {Host: "c"}}, endpoints, "the list is left alone")
+}
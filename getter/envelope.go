@@ -0,0 +1,328 @@
+package getter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EnvelopeCipher allows us to have a type safe value naming the cipher an envelope is sealed with
+type EnvelopeCipher byte
+
+const (
+	// EnvelopeAESGCM seals envelopes with AES-256-GCM
+	EnvelopeAESGCM EnvelopeCipher = 1
+	// EnvelopeChaCha20Poly1305 seals envelopes with ChaCha20-Poly1305
+	EnvelopeChaCha20Poly1305 EnvelopeCipher = 2
+)
+
+const (
+	// envelopeMagic starts every envelope header
+	envelopeMagic = "FGE1"
+	// envelopeMetadataKey is the user metadata holding the base64 envelope header of a remote file whose
+	// content is only the sealed chunks
+	envelopeMetadataKey = "Envelope"
+	// envelopeNoncePrefixSize is how much of each chunk's nonce is random, the rest is the chunk counter and
+	// the final chunk flag
+	envelopeNoncePrefixSize = 7
+	// envelopeMaxChunkSize bounds the memory a chunk takes
+	envelopeMaxChunkSize = 16 << 20
+	// envelopeDataKeySize is the size of the data keys both ciphers use
+	envelopeDataKeySize = 32
+)
+
+// ErrDecryption is reported for envelopes that cannot be opened: malformed headers, keys that do not unwrap,
+// and content that fails authentication because it was tampered with, truncated or reordered
+var ErrDecryption = errors.New("unable to decrypt envelope")
+
+// KeyUnwrapper turns the wrapped data key of an envelope back into the key that seals its content, usually
+// with a key management service
+type KeyUnwrapper interface {
+	// UnwrapKey returns the data key wrapped by the key encryption key called keyID
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyUnwrapperFunc is a function used as a KeyUnwrapper
+type KeyUnwrapperFunc func(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+
+// UnwrapKey calls f
+func (f KeyUnwrapperFunc) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	return f(ctx, keyID, wrapped)
+}
+
+// StaticKEKs is a KeyUnwrapper holding 32 byte key encryption keys by ID. A wrapped key is the 12 byte nonce
+// followed by the data key sealed with AES-256-GCM under the key encryption key, with the key ID as
+// additional data.
+type StaticKEKs map[string][]byte
+
+// UnwrapKey opens wrapped with the key encryption key called keyID
+func (k StaticKEKs) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := k[keyID]
+	if !ok {
+		return nil, errors.Errorf("unknown key encryption key %q", keyID)
+	}
+	aead, err := newEnvelopeAEAD(EnvelopeAESGCM, kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, errors.New("wrapped key does not authenticate")
+	}
+	return key, nil
+}
+
+// WithEnvelopeDecryption decrypts files sealed in envelopes as they are read, whether they come from the remote
+// or the local file system. Files that are not envelopes are returned as they are, as are ranges.
+//
+// An envelope is a header followed by the content sealed in chunks. The header is
+//
+//	"FGE1" | cipher (1 byte) | chunk size (4 bytes) | nonce prefix (7 bytes) |
+//	key ID length (1 byte) | key ID | wrapped key length (2 bytes) | wrapped key
+//
+// with integers big endian. Remote files may instead carry the header, base64 encoded, in their Envelope
+// user metadata and hold only the chunks. Each chunk holds chunk size bytes of content, the last one possibly
+// fewer, sealed with the unwrapped data key and the header as additional data. Its nonce is the nonce prefix,
+// the chunk's 4 byte index and a byte set to 1 on the last chunk only, so chunks are authenticated as they are
+// read and truncation or reordering is caught.
+func WithEnvelopeDecryption(u KeyUnwrapper) Option {
+	return func(g *Getter) {
+		g.unwrapper = u
+	}
+}
+
+// envelopeHeader is the parsed header of an envelope
+type envelopeHeader struct {
+	cipher      EnvelopeCipher
+	chunkSize   int
+	noncePrefix [envelopeNoncePrefixSize]byte
+	keyID       string
+	wrappedKey  []byte
+	// raw is the header as it was stored, authenticated along with every chunk
+	raw []byte
+}
+
+// decrypt opens res.Body when it is an envelope and decryption is on. Errors are from reading the header or
+// unwrapping the data key, and the body has been closed.
+func (g *Getter) decrypt(ctx context.Context, req FetchRequest, res *FetchResult) error {
+	if g.unwrapper == nil || req.Range != nil {
+		return nil
+	}
+
+	body := bufio.NewReader(res.Body)
+	var hdr *envelopeHeader
+	var err error
+	if encoded, ok := res.Metadata[envelopeMetadataKey]; ok {
+		var raw []byte
+		if raw, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			err = errors.Wrap(ErrDecryption, "envelope metadata is not base64")
+		} else {
+			hdr, err = readEnvelopeHeader(bytes.NewReader(raw))
+		}
+	} else if magic, _ := body.Peek(len(envelopeMagic)); string(magic) == envelopeMagic {
+		hdr, err = readEnvelopeHeader(body)
+	} else {
+		res.Body = readCloser{Reader: body, Closer: res.Body}
+		return nil
+	}
+	if err != nil {
+		res.Body.Close()
+		return err
+	}
+
+	key, err := g.unwrapper.UnwrapKey(ctx, hdr.keyID, hdr.wrappedKey)
+	if err != nil {
+		res.Body.Close()
+		return errors.Wrapf(ErrDecryption, "unable to unwrap data key with key %q - %v", hdr.keyID, err)
+	}
+	aead, err := newEnvelopeAEAD(hdr.cipher, key)
+	if err != nil {
+		res.Body.Close()
+		return errors.Wrap(ErrDecryption, err.Error())
+	}
+
+	if res.Size >= 0 {
+		sealed := res.Size
+		if _, ok := res.Metadata[envelopeMetadataKey]; !ok {
+			sealed -= int64(len(hdr.raw))
+		}
+		res.Size = hdr.plainSize(sealed, aead.Overhead())
+	}
+	res.Body = &envelopeReader{
+		r:      body,
+		closer: res.Body,
+		aead:   aead,
+		hdr:    hdr,
+		chunk:  make([]byte, hdr.chunkSize+aead.Overhead()),
+	}
+	res.Decrypted = true
+	return nil
+}
+
+// isEnvelope reports whether res, whose body is rs, is an envelope, going by its metadata or its first bytes
+func isEnvelope(res *FetchResult, rs io.ReaderAt) bool {
+	if _, ok := res.Metadata[envelopeMetadataKey]; ok {
+		return true
+	}
+	magic := make([]byte, len(envelopeMagic))
+	n, _ := rs.ReadAt(magic, 0)
+	return string(magic[:n]) == envelopeMagic
+}
+
+// readEnvelopeHeader parses the header at the start of r
+func readEnvelopeHeader(r io.Reader) (*envelopeHeader, error) {
+	var raw bytes.Buffer
+	r = io.TeeReader(r, &raw)
+	fixed := make([]byte, len(envelopeMagic)+1+4+envelopeNoncePrefixSize+1)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, errors.Wrapf(ErrDecryption, "envelope header is truncated - %v", err)
+	}
+	if string(fixed[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, errors.Wrap(ErrDecryption, "not an envelope")
+	}
+
+	hdr := &envelopeHeader{}
+	rest := fixed[len(envelopeMagic):]
+	hdr.cipher = EnvelopeCipher(rest[0])
+	hdr.chunkSize = int(binary.BigEndian.Uint32(rest[1:5]))
+	copy(hdr.noncePrefix[:], rest[5:5+envelopeNoncePrefixSize])
+	if hdr.chunkSize < 1 || hdr.chunkSize > envelopeMaxChunkSize {
+		return nil, errors.Wrapf(ErrDecryption, "envelope chunk size %d is out of range", hdr.chunkSize)
+	}
+
+	keyID := make([]byte, rest[len(rest)-1])
+	var wrappedLen [2]byte
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, errors.Wrapf(ErrDecryption, "envelope header is truncated - %v", err)
+	}
+	if _, err := io.ReadFull(r, wrappedLen[:]); err != nil {
+		return nil, errors.Wrapf(ErrDecryption, "envelope header is truncated - %v", err)
+	}
+	hdr.keyID = string(keyID)
+	hdr.wrappedKey = make([]byte, binary.BigEndian.Uint16(wrappedLen[:]))
+	if _, err := io.ReadFull(r, hdr.wrappedKey); err != nil {
+		return nil, errors.Wrapf(ErrDecryption, "envelope header is truncated - %v", err)
+	}
+	hdr.raw = raw.Bytes()
+	return hdr, nil
+}
+
+// plainSize returns the size of the content sealed in sealedSize bytes of chunks
+func (h *envelopeHeader) plainSize(sealedSize int64, overhead int) int64 {
+	sealedChunk := int64(h.chunkSize + overhead)
+	chunks := (sealedSize + sealedChunk - 1) / sealedChunk
+	if chunks == 0 {
+		return -1
+	}
+	return sealedSize - chunks*int64(overhead)
+}
+
+// nonce returns the nonce of chunk n
+func (h *envelopeHeader) nonce(n uint32, last bool) []byte {
+	nonce := make([]byte, envelopeNoncePrefixSize+5)
+	copy(nonce, h.noncePrefix[:])
+	binary.BigEndian.PutUint32(nonce[envelopeNoncePrefixSize:], n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// newEnvelopeAEAD returns c keyed with key
+func newEnvelopeAEAD(c EnvelopeCipher, key []byte) (cipher.AEAD, error) {
+	if len(key) != envelopeDataKeySize {
+		return nil, errors.Errorf("key is %d bytes, it must be %d", len(key), envelopeDataKeySize)
+	}
+	switch c {
+	case EnvelopeAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case EnvelopeChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, errors.Errorf("unknown envelope cipher %d", c)
+}
+
+// envelopeReader opens the chunks of an envelope as they are read. Content is only handed over once the
+// chunk holding it has been authenticated.
+type envelopeReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	hdr    *envelopeHeader
+
+	// chunk is the buffer sealed chunks are read into and opened in place
+	chunk []byte
+	// plain is what is left of the last chunk opened
+	plain []byte
+	n     uint32
+	done  bool
+	err   error
+}
+
+// Read hands over authenticated content, reporting ErrDecryption for content that does not authenticate
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for len(e.plain) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.err = e.next()
+	}
+	n := copy(p, e.plain)
+	e.plain = e.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (e *envelopeReader) next() error {
+	n, err := io.ReadFull(e.r, e.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		// the last chunk was not marked as such, so the content was cut short
+		return ErrDecryption
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := e.r.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+	if e.n == ^uint32(0) {
+		return errors.Wrap(ErrDecryption, "too many chunks")
+	}
+
+	plain, err := e.aead.Open(e.chunk[:0], e.hdr.nonce(e.n, last), e.chunk[:n], e.hdr.raw)
+	if err != nil {
+		return ErrDecryption
+	}
+	e.plain, e.done = plain, last
+	e.n++
+	return nil
+}
+
+// Close closes the underlying file
+func (e *envelopeReader) Close() error {
+	return e.closer.Close()
+}
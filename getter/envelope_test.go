@@ -0,0 +1,297 @@
+package getter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKEKs holds the key encryption key the envelopes of the tests are wrapped with
+var testKEKs = StaticKEKs{"kek-1": bytes.Repeat([]byte("k"), 32)}
+
+// sealEnvelope seals plain in chunks of chunkSize, wrapping a new data key with the kek-1 of testKEKs.
+// It returns the header and the chunks separately.
+func sealEnvelope(t *testing.T, c EnvelopeCipher, plain []byte, chunkSize int) (header, chunks []byte) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	require.NoError(t, err)
+
+	kek, err := newEnvelopeAEAD(EnvelopeAESGCM, testKEKs["kek-1"])
+	require.NoError(t, err)
+	wrapped := make([]byte, kek.NonceSize())
+	_, err = rand.Read(wrapped)
+	require.NoError(t, err)
+	wrapped = kek.Seal(wrapped, wrapped, dataKey, []byte("kek-1"))
+
+	hdr := &envelopeHeader{cipher: c, chunkSize: chunkSize}
+	_, err = rand.Read(hdr.noncePrefix[:])
+	require.NoError(t, err)
+	var raw bytes.Buffer
+	raw.WriteString(envelopeMagic)
+	raw.WriteByte(byte(c))
+	binary.Write(&raw, binary.BigEndian, uint32(chunkSize))
+	raw.Write(hdr.noncePrefix[:])
+	raw.WriteByte(byte(len("kek-1")))
+	raw.WriteString("kek-1")
+	binary.Write(&raw, binary.BigEndian, uint16(len(wrapped)))
+	raw.Write(wrapped)
+	hdr.raw = raw.Bytes()
+
+	aead, err := newEnvelopeAEAD(c, dataKey)
+	require.NoError(t, err)
+	var sealed []byte
+	for n := uint32(0); ; n++ {
+		size := chunkSize
+		if len(plain) <= chunkSize {
+			size = len(plain)
+		}
+		last := len(plain) <= chunkSize
+		sealed = aead.Seal(sealed, hdr.nonce(n, last), plain[:size], hdr.raw)
+		plain = plain[size:]
+		if last {
+			return hdr.raw, sealed
+		}
+	}
+}
+
+// TestFetchEnvelope verifies that envelopes from either file system are decrypted, with the header in the
+// file or in the remote file's metadata
+func TestFetchEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s3 := newFakeS3(t)
+	defer s3.Close()
+
+	mail := bytes.Repeat([]byte("Subject: secret\r\n\r\nbody "), 10)
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(mail)
+	gw.Close()
+
+	for _, test := range []struct {
+		name      string
+		cipher    EnvelopeCipher
+		plain     []byte
+		chunkSize int
+		remote    bool
+		metadata  bool
+		opts      []Option
+		expected  []byte
+	}{
+		{name: "local aes-gcm", cipher: EnvelopeAESGCM, plain: mail, chunkSize: 16},
+		{name: "local chacha20-poly1305", cipher: EnvelopeChaCha20Poly1305, plain: mail, chunkSize: 64},
+		{name: "remote", cipher: EnvelopeAESGCM, plain: mail, chunkSize: 1024, remote: true},
+		{name: "remote metadata header", cipher: EnvelopeChaCha20Poly1305, plain: mail, chunkSize: 16, remote: true, metadata: true},
+		{name: "whole chunks", cipher: EnvelopeAESGCM, plain: mail[:48], chunkSize: 16},
+		{name: "empty", cipher: EnvelopeAESGCM, plain: []byte{}, chunkSize: 16},
+		{name: "compressed", cipher: EnvelopeAESGCM, plain: gz.Bytes(), chunkSize: 32, opts: []Option{WithDecompression()}, expected: mail},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			header, chunks := sealEnvelope(t, test.cipher, test.plain, test.chunkSize)
+			req := FetchRequest{}
+			switch {
+			case test.metadata:
+				s3.PutWithHeader("bucket", "mail.eml", chunks, http.Header{"X-Amz-Meta-Envelope": []string{base64.StdEncoding.EncodeToString(header)}})
+				req = FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}
+			case test.remote:
+				s3.Put("bucket", "mail.eml", append(header, chunks...))
+				req = FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}
+			default:
+				req.LocalPath = filepath.Join(dir, "mail.eml")
+				require.NoError(t, ioutil.WriteFile(req.LocalPath, append(header, chunks...), 0600))
+			}
+
+			fetcher := New(discardLogger(), true, "key", "secret", append(test.opts, WithEnvelopeDecryption(testKEKs), WithETagVerification())...)
+			res, err := fetcher.FetchObject(context.Background(), req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+
+			expected := test.expected
+			if expected == nil {
+				expected = test.plain
+				assert.Equal(t, int64(len(test.plain)), res.Size)
+			}
+			assert.Equal(t, expected, body)
+			assert.True(t, res.Decrypted)
+		})
+	}
+}
+
+// TestFetchEnvelopeTampered verifies that content is only handed over once it authenticates, and that
+// tampering, truncation and reordering are reported as ErrDecryption
+func TestFetchEnvelopeTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.eml")
+
+	plain := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	header, chunks := sealEnvelope(t, EnvelopeAESGCM, plain, 16)
+	sealedChunk := 16 + 16
+
+	for _, test := range []struct {
+		name          string
+		tamper        func(header, chunks []byte) []byte
+		unwrapper     KeyUnwrapper
+		expectedPlain []byte
+		fetchFails    bool
+	}{
+		{name: "flipped bit", tamper: func(header, chunks []byte) []byte {
+			chunks[2*sealedChunk+3] ^= 1
+			return append(header, chunks...)
+		}, expectedPlain: plain[:32]},
+		{name: "truncated", tamper: func(header, chunks []byte) []byte {
+			return append(header, chunks[:3*sealedChunk]...)
+		}, expectedPlain: plain[:32]},
+		{name: "reordered", tamper: func(header, chunks []byte) []byte {
+			swapped := append([]byte{}, chunks[sealedChunk:2*sealedChunk]...)
+			swapped = append(swapped, chunks[:sealedChunk]...)
+			return append(append(header, swapped...), chunks[2*sealedChunk:]...)
+		}, expectedPlain: []byte{}},
+		{name: "header", tamper: func(header, chunks []byte) []byte {
+			// the nonce prefix
+			header[len(envelopeMagic)+6] ^= 1
+			return append(header, chunks...)
+		}, expectedPlain: []byte{}},
+		{name: "only the header", tamper: func(header, chunks []byte) []byte {
+			return header
+		}, expectedPlain: []byte{}},
+		{name: "unknown key", tamper: func(header, chunks []byte) []byte {
+			return append(header, chunks...)
+		}, unwrapper: StaticKEKs{}, fetchFails: true},
+		{name: "bad chunk size", tamper: func(header, chunks []byte) []byte {
+			binary.BigEndian.PutUint32(header[len(envelopeMagic)+1:], 0)
+			return append(header, chunks...)
+		}, fetchFails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := test.tamper(append([]byte{}, header...), append([]byte{}, chunks...))
+			require.NoError(t, ioutil.WriteFile(path, data, 0600))
+			unwrapper := test.unwrapper
+			if unwrapper == nil {
+				unwrapper = testKEKs
+			}
+
+			fetcher := New(discardLogger(), false, "key", "secret", WithEnvelopeDecryption(unwrapper))
+			fh, _, err := fetcher.Fetch(context.Background(), FetchRequest{LocalPath: path})
+			if test.fetchFails {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, ErrDecryption), "%v", err)
+				return
+			}
+			require.NoError(t, err)
+			defer fh.Close()
+
+			var got []byte
+			buf := make([]byte, 7)
+			for {
+				n, err := fh.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					assert.Equal(t, ErrDecryption, err)
+					break
+				}
+			}
+			assert.Equal(t, test.expectedPlain, append([]byte{}, got...), "only authenticated content is handed over")
+		})
+	}
+}
+
+// TestFetchEnvelopeOff verifies that files are returned as stored when they are not envelopes or decryption is off
+func TestFetchEnvelopeOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	header, chunks := sealEnvelope(t, EnvelopeAESGCM, []byte("secret"), 16)
+	sealed := filepath.Join(dir, "sealed.eml")
+	plain := filepath.Join(dir, "plain.eml")
+	require.NoError(t, ioutil.WriteFile(sealed, append(header, chunks...), 0600))
+	require.NoError(t, ioutil.WriteFile(plain, []byte("FGE"), 0600))
+
+	for _, test := range []struct {
+		name     string
+		path     string
+		opts     []Option
+		expected []byte
+	}{
+		{name: "off", path: sealed, expected: append(header, chunks...)},
+		{name: "not an envelope", path: plain, opts: []Option{WithEnvelopeDecryption(testKEKs)}, expected: []byte("FGE")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), false, "key", "secret", test.opts...)
+			res, err := fetcher.FetchObject(context.Background(), FetchRequest{LocalPath: test.path})
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, body)
+			assert.False(t, res.Decrypted)
+		})
+	}
+}
+
+// TestFetchSeekableEnvelope verifies that seekable fetches refuse envelopes rather than hand over their
+// ciphertext when decryption is on
+func TestFetchSeekableEnvelope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s3 := newFakeS3(t)
+	defer s3.Close()
+
+	header, chunks := sealEnvelope(t, EnvelopeAESGCM, []byte("secret"), 16)
+	sealed := append(header, chunks...)
+	sealedPath := filepath.Join(dir, "sealed.eml")
+	plainPath := filepath.Join(dir, "plain.eml")
+	require.NoError(t, ioutil.WriteFile(sealedPath, sealed, 0600))
+	require.NoError(t, ioutil.WriteFile(plainPath, []byte("plain"), 0600))
+	s3.Put("bucket", "sealed.eml", sealed)
+	s3.PutWithHeader("bucket", "metadata.eml", chunks, http.Header{"X-Amz-Meta-Envelope": []string{base64.StdEncoding.EncodeToString(header)}})
+
+	for _, test := range []struct {
+		name        string
+		req         FetchRequest
+		off         bool
+		expected    []byte
+		expectedErr bool
+	}{
+		{name: "local", req: FetchRequest{LocalPath: sealedPath}, expectedErr: true},
+		{name: "remote", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "sealed.eml"}, expectedErr: true},
+		{name: "remote metadata header", req: FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "metadata.eml"}, expectedErr: true},
+		{name: "not an envelope", req: FetchRequest{LocalPath: plainPath}, expected: []byte("plain")},
+		{name: "off", req: FetchRequest{LocalPath: sealedPath}, off: true, expected: sealed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var opts []Option
+			if !test.off {
+				opts = append(opts, WithEnvelopeDecryption(testKEKs))
+			}
+			fetcher := New(discardLogger(), test.req.Host != "", "key", "secret", opts...)
+			rs, _, err := fetcher.FetchSeekable(context.Background(), test.req)
+			if test.expectedErr {
+				assert.True(t, errors.Is(err, ErrDecryption), "%v", err)
+				return
+			}
+			require.NoError(t, err)
+			defer rs.Close()
+			body, err := ioutil.ReadAll(rs)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, body)
+		})
+	}
+}
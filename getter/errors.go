@@ -0,0 +1,144 @@
+package getter
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is reported when the file does not exist in the source that was asked for it
+	ErrNotFound = errors.New("file not found")
+	// ErrAccessDenied is reported when the source refused to hand over the file
+	ErrAccessDenied = errors.New("access denied")
+	// ErrInvalidRequest is reported for requests that cannot be served, such as ones missing both a
+	// local path and a complete remote location
+	ErrInvalidRequest = errors.New("invalid fetch request")
+)
+
+// notFoundCodes are remote error codes meaning the file is not there
+var notFoundCodes = map[string]bool{
+	"NoSuchKey":     true,
+	"NoSuchBucket":  true,
+	"NoSuchVersion": true,
+	"NoSuchObject":  true,
+}
+
+// accessDeniedCodes are remote error codes meaning we may not read the file
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+}
+
+// FetchError describes a failed fetch. errors.Is matches it against the sentinel it was classified as,
+// such as ErrNotFound, and errors.As can reach the underlying cause, such as a minio.ErrorResponse or
+// *os.PathError.
+type FetchError struct {
+	// Source is where the failing fetch was made, empty when no source was tried
+	Source Source
+	// LocalPath, Host, Bucket and Key are the location that was asked for
+	LocalPath string
+	Host      string
+	Bucket    string
+	Key       string
+	// URL is the URL that was asked for, redacted of its query and user info
+	URL string
+	// Kind is the sentinel error the failure was classified as, nil when it did not match any
+	Kind error
+	// Err is the underlying cause
+	Err error
+}
+
+// Error describes the failure and where it happened
+func (e *FetchError) Error() string {
+	prefix := "fetch"
+	if e.Source != "" {
+		prefix = string(e.Source) + " fetch"
+	}
+	if e.URL != "" {
+		return fmt.Sprintf(`%s failed. "path":%q, "host":%q, "bucket":%q, "key":%q, "url":%q - %v`, prefix, e.LocalPath, e.Host, e.Bucket, e.Key, e.URL, e.Err)
+	}
+	return fmt.Sprintf(`%s failed. "path":%q, "host":%q, "bucket":%q, "key":%q - %v`, prefix, e.LocalPath, e.Host, e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying cause, stripped of any github.com/pkg/errors context
+// so that errors.Is and errors.As can see it
+func (e *FetchError) Unwrap() error {
+	return errors.Cause(e.Err)
+}
+
+// Is reports whether the failure was classified as target
+func (e *FetchError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newFetchError classifies err, which happened while fetching req from source
+func newFetchError(source Source, req FetchRequest, err error) *FetchError {
+	fe := &FetchError{
+		Source:    source,
+		LocalPath: req.LocalPath,
+		Host:      req.Host,
+		Bucket:    req.Bucket,
+		Key:       req.Key,
+		Kind:      classify(err),
+		Err:       err,
+	}
+	if req.URL != "" {
+		fe.URL = redactURL(req.URL)
+	}
+	return fe
+}
+
+// invalidRequestError reports why req cannot be served
+func invalidRequestError(req FetchRequest, err error) *FetchError {
+	fe := newFetchError("", req, err)
+	fe.Kind = ErrInvalidRequest
+	return fe
+}
+
+// classify maps err onto one of the exported sentinel errors, returning nil when none fits
+func classify(err error) error {
+	cause := errors.Cause(err)
+	switch cause {
+	case ErrNotFound, ErrAccessDenied, ErrInvalidRequest, ErrCircuitOpen, ErrTooLarge, ErrDecryption:
+		return cause
+	}
+
+	if httpErr, ok := cause.(*HTTPError); ok {
+		switch httpErr.StatusCode {
+		case http.StatusNotFound, http.StatusGone:
+			return ErrNotFound
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrAccessDenied
+		}
+		return nil
+	}
+
+	switch {
+	case os.IsNotExist(cause):
+		return ErrNotFound
+	case os.IsPermission(cause):
+		return ErrAccessDenied
+	}
+
+	resp, ok := cause.(minio.ErrorResponse)
+	if !ok {
+		return nil
+	}
+	switch {
+	case notFoundCodes[resp.Code] || resp.StatusCode == 404:
+		return ErrNotFound
+	case accessDeniedCodes[resp.Code] || resp.StatusCode == 403:
+		return ErrAccessDenied
+	case resp.Code == "InvalidBucketName" || resp.Code == "XMinioInvalidObjectName" || resp.Code == "InvalidArgument":
+		return ErrInvalidRequest
+	}
+	return nil
+}
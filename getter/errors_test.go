@@ -0,0 +1,83 @@
+package getter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minio/minio-go"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClassify verifies how causes map onto the exported sentinel errors
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{name: "missing key", err: minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, expected: ErrNotFound},
+		{name: "missing bucket", err: minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: 404}, expected: ErrNotFound},
+		{name: "bare 404", err: minio.ErrorResponse{StatusCode: 404}, expected: ErrNotFound},
+		{name: "access denied", err: minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, expected: ErrAccessDenied},
+		{name: "bad signature", err: minio.ErrorResponse{Code: "SignatureDoesNotMatch", StatusCode: 403}, expected: ErrAccessDenied},
+		{name: "unknown key id", err: minio.ErrorResponse{Code: "InvalidAccessKeyId", StatusCode: 403}, expected: ErrAccessDenied},
+		{name: "invalid bucket name", err: minio.ErrInvalidBucketName("Bucket name cannot be empty"), expected: ErrInvalidRequest},
+		{name: "server error", err: minio.ErrorResponse{Code: "InternalError", StatusCode: 500}, expected: nil},
+		{name: "wrapped remote error", err: pkgerrors.Wrap(minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, "unable to get remote file info"), expected: ErrNotFound},
+		{name: "local missing file", err: &os.PathError{Op: "open", Path: "/nope", Err: os.ErrNotExist}, expected: ErrNotFound},
+		{name: "local permission", err: &os.PathError{Op: "open", Path: "/nope", Err: os.ErrPermission}, expected: ErrAccessDenied},
+		{name: "circuit open", err: pkgerrors.Wrapf(ErrCircuitOpen, "host %q", "host"), expected: ErrCircuitOpen},
+		{name: "unknown", err: fmt.Errorf("unable to read from disk"), expected: nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, classify(test.err))
+		})
+	}
+}
+
+// TestFetchErrorIsAs verifies that errors.Is and errors.As see both the classification and the cause
+func TestFetchErrorIsAs(t *testing.T) {
+	req := FetchRequest{LocalPath: "/var/mail/x.eml", Host: "host", Bucket: "bucket", Key: "key"}
+	cause := minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404, Message: "The specified key does not exist."}
+	var err error = newFetchError(Remote, req, pkgerrors.Wrap(cause, "unable to get remote file info"))
+
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.False(t, errors.Is(err, ErrAccessDenied))
+
+	var resp minio.ErrorResponse
+	require.True(t, errors.As(err, &resp))
+	assert.Equal(t, "NoSuchKey", resp.Code)
+
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr))
+	assert.Equal(t, Remote, fetchErr.Source)
+	assert.Equal(t, "host", fetchErr.Host)
+	assert.Equal(t, "bucket", fetchErr.Bucket)
+	assert.Equal(t, "key", fetchErr.Key)
+	assert.Equal(t, `remote fetch failed. "path":"/var/mail/x.eml", "host":"host", "bucket":"bucket", "key":"key" - unable to get remote file info: The specified key does not exist.`, err.Error())
+}
+
+// TestFetchErrorLocal verifies the errors reported by real local fetches
+func TestFetchErrorLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fetcher := New(discardLogger(), false, "key", "secret")
+	_, source, err := fetcher.Fetch(context.Background(), FetchRequest{LocalPath: filepath.Join(dir, "missing.eml")})
+	assert.Equal(t, Local, source)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	var pathErr *os.PathError
+	assert.True(t, errors.As(err, &pathErr))
+
+	_, _, err = fetcher.Fetch(context.Background(), FetchRequest{Bucket: "bucket"})
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+}
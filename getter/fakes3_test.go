@@ -0,0 +1,179 @@
+package getter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal S3 compatible server that understands just enough of the protocol for minio-go
+// to locate a bucket and GET or HEAD an object
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+
+	locationRequests int64
+	objectRequests   int64
+	// getRequests counts the object requests that were GETs rather than HEADs
+	getRequests int64
+	// accessKeys lists the access key each object request was signed with
+	accessKeys []string
+	// authHeaders lists the Authorization header of each object request
+	authHeaders []string
+	// ranges lists the Range header of each object request
+	ranges []string
+}
+
+// fakeObject is an object stored in a fakeS3
+type fakeObject struct {
+	data []byte
+	// header is sent along with the object, for content types and user metadata
+	header http.Header
+	// customerKey is the SSE-C key the object is encrypted with, nil when it is not
+	customerKey []byte
+	// status and code make every request for the object fail with this error when status is set
+	status int
+	code   string
+}
+
+// fakeS3ModTime is reported as the Last-Modified time of every object
+var fakeS3ModTime = time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// newFakeS3 starts a plain HTTP fakeS3. The caller must Close it.
+func newFakeS3(tb testing.TB) *fakeS3 {
+	f := &fakeS3{objects: map[string]fakeObject{}}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// newFakeS3TLS starts a fakeS3 serving HTTPS with cfg, which may be nil. The caller must Close it.
+func newFakeS3TLS(tb testing.TB, cfg *tls.Config) *fakeS3 {
+	f := &fakeS3{objects: map[string]fakeObject{}}
+	f.Server = httptest.NewUnstartedServer(f)
+	f.Server.TLS = cfg
+	f.Server.StartTLS()
+	return f
+}
+
+// Host returns the host:port minio-go should dial to reach the server
+func (f *fakeS3) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(f.URL, "http://"), "https://")
+}
+
+// Put stores data under bucket/key
+func (f *fakeS3) Put(bucket, key string, data []byte) {
+	f.PutWithHeader(bucket, key, data, nil)
+}
+
+// PutEncrypted stores data under bucket/key, to be served only to requests carrying the SSE-C customerKey
+func (f *fakeS3) PutEncrypted(bucket, key string, data, customerKey []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = fakeObject{data: data, customerKey: customerKey}
+}
+
+// PutError makes every request for bucket/key fail with status and the S3 error code
+func (f *fakeS3) PutError(bucket, key string, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = fakeObject{status: status, code: code}
+}
+
+// PutWithHeader stores data under bucket/key, to be served along with header
+func (f *fakeS3) PutWithHeader(bucket, key string, data []byte, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = fakeObject{data: data, header: header}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if _, ok := r.URL.Query()["location"]; ok {
+		atomic.AddInt64(&f.locationRequests, 1)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+
+	atomic.AddInt64(&f.objectRequests, 1)
+	if r.Method == http.MethodGet {
+		atomic.AddInt64(&f.getRequests, 1)
+	}
+	f.mu.Lock()
+	f.accessKeys = append(f.accessKeys, accessKeyFromAuth(r.Header.Get("Authorization")))
+	f.authHeaders = append(f.authHeaders, r.Header.Get("Authorization"))
+	f.ranges = append(f.ranges, r.Header.Get("Range"))
+	obj, ok := f.objects[path]
+	f.mu.Unlock()
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	if obj.status != 0 {
+		writeS3Error(w, obj.status, obj.code, "Injected failure.")
+		return
+	}
+
+	sum := md5.Sum(obj.data)
+	if obj.customerKey != nil {
+		switch r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key") {
+		case "":
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption.")
+			return
+		case base64.StdEncoding.EncodeToString(obj.customerKey):
+		default:
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		}
+		// the ETag of an encrypted object is not the MD5 of its content
+		sum = md5.Sum(append([]byte("encrypted "), obj.data...))
+		w.Header().Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Content-Type", "message/rfc822")
+	for k, v := range obj.header {
+		w.Header()[k] = v
+	}
+	http.ServeContent(w, r, "", fakeS3ModTime, bytes.NewReader(obj.data))
+}
+
+// signedWith returns the access keys object requests have been signed with so far
+func (f *fakeS3) signedWith() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.accessKeys...)
+}
+
+// accessKeyFromAuth pulls the access key out of a V2 or V4 Authorization header
+func accessKeyFromAuth(auth string) string {
+	switch {
+	case strings.HasPrefix(auth, "AWS "):
+		// AWS AKID:signature
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		// AWS4-HMAC-SHA256 Credential=AKID/date/region/s3/aws4_request, ...
+		cred := strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 Credential=")
+		return strings.SplitN(cred, "/", 2)[0]
+	}
+	return ""
+}
+
+// writeS3Error writes an S3 style XML error document
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
@@ -1,15 +1,21 @@
 package getter
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
 	"github.com/pkg/errors"
 )
 
-// Source allows us to have a type safe return value specifying if a file was remote or local
+// Source allows us to have a type safe return value specifying which backend served a file, see Backend
 type Source string
 
 const (
@@ -17,96 +23,291 @@ const (
 	Local Source = "local"
 	//Remote signifies we are using a remote file source
 	Remote Source = "remote"
+	// Cached signifies a remote file was served from the disk cache, see WithDiskCache
+	Cached Source = "cached"
 )
 
 // FileFetcher allows us to get a ReadCloser, the source (remote/local), or an error when attempting to get
 // a file from either local or remote storage
 type FileFetcher interface {
 	FetchFile(localPath, host, bucket, key string) (io.ReadCloser, Source, error)
+	FetchFileContext(ctx context.Context, localPath, host, bucket, key string) (io.ReadCloser, Source, error)
+	Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, Source, error)
 }
 
 // Getter contains unexported fields allowing the local or remote fetching of files
 type Getter struct {
-	logger       *log.Logger
-	useRemoteFS  bool
-	accessKey    string
-	accessSecret string
+	logger     *log.Logger
+	strategy   Strategy
+	creds      *credentials.Credentials
+	secure     bool
+	tlsConfig  *tls.Config
+	transport  *http.Transport
+	signature  credentials.SignatureType
+	hedgeDelay time.Duration
+	retry      RetryPolicy
+	clock      Clock
+	random     func() float64
 
-	remoteFetcher remoteFetcher
-	localFetcher  localFetcher
+	verifyETag   bool
+	decompress   bool
+	sseKeys      KeyProvider
+	unwrapper    KeyUnwrapper
+	httpSettings HTTPSettings
+	cache        *DiskCache
+	endpoints    map[string]EndpointList
+	flights      *flights
+
+	breakerSettings *BreakerSettings
+	breakers        *breakers
+
+	clients *clientPool
+	// remote, local and http are the built in backends, see WithBackends
+	remote       Backend
+	local        Backend
+	http         Backend
+	backendChain []string
+}
+
+// Option configures optional behaviour of a Getter
+type Option func(*Getter)
+
+// WithClientIdleTimeout sets how long a remote client is kept around without being used.
+// Zero or less keeps clients for the life of the Getter.
+func WithClientIdleTimeout(d time.Duration) Option {
+	return func(g *Getter) {
+		g.clients.idleTimeout = d
+	}
 }
 
 // New creates a instatialized Getter that can get files locally or remotely.
-// useRemoteFS tells us if the service is configured to use the remote file system.
-// accessKey and accessSecret are authentication parts for the remote file system.
-func New(logger *log.Logger, useRemoteFS bool, accessKey, accessSecret string) *Getter {
-	return &Getter{
-		logger:        logger,
-		useRemoteFS:   useRemoteFS,
-		accessKey:     accessKey,
-		accessSecret:  accessSecret,
-		remoteFetcher: &minioWrapper{},
-		localFetcher:  &osFile{},
+// useRemoteFS tells us if the service is configured to use the remote file system, choosing the RemoteFirst
+// or LocalOnly strategy, see WithStrategy for others.
+// accessKey and accessSecret are authentication parts for the remote file system, see WithCredentials
+// for a way to avoid static keys. opts may be used to change the defaults of optional behaviour.
+func New(logger *log.Logger, useRemoteFS bool, accessKey, accessSecret string, opts ...Option) *Getter {
+	clients := newClientPool(DefaultClientIdleTimeout)
+	g := &Getter{
+		logger:   logger,
+		strategy: defaultStrategy(useRemoteFS),
+		creds:    credentials.NewStaticV2(accessKey, accessSecret, ""),
+		clients:  clients,
+		local:    &osFile{},
+		clock:    realClock{},
+		random:   rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.remote == nil {
+		g.remote = &minioWrapper{clients: clients, creds: g.creds, keys: g.sseKeys, secure: g.secure}
 	}
+	if g.tlsConfig != nil {
+		g.transport = newTransport(g.tlsConfig)
+	}
+	// URLs point anywhere, so they get neither the certificate authorities nor the client certificates of
+	// the remote file system
+	g.http = newHTTPBackend(g.httpSettings, newTransport(g.httpSettings.TLSConfig.Clone()))
+	if g.breakerSettings != nil {
+		g.breakers = newBreakers(*g.breakerSettings, g.clock, g.logger)
+	}
+	clients.newClient = g.newMinioClient
+	return g
 }
 
-// FetchFile will reach out to s3 or use the local file system to retrieve an email file
+// FetchFile will reach out to s3 or use the local file system to retrieve an email file.
+// A localPath or key such as bundle.tar.gz#path/in/archive fetches a single member of a tar or zip archive.
 func (g *Getter) FetchFile(localPath, host, bucket, key string) (io.ReadCloser, Source, error) {
-	if g.useRemoteFS && host != "" && key != "" && bucket != "" {
-		// we have everything we need to do remote fs stuff
-		fh, err := g.remoteFetcher.FetchRemoteFile(g.accessKey, g.accessSecret, host, bucket, key)
-		if err == nil {
-			return fh, Remote, nil
-		}
+	return g.FetchFileContext(context.Background(), localPath, host, bucket, key)
+}
+
+// FetchFileContext is FetchFile bound to ctx. Cancelling ctx aborts the remote request, skips the
+// local fallback, and stops any read of the returned ReadCloser that is still in progress.
+func (g *Getter) FetchFileContext(ctx context.Context, localPath, host, bucket, key string) (io.ReadCloser, Source, error) {
+	return g.Fetch(ctx, FetchRequest{LocalPath: localPath, Host: host, Bucket: bucket, Key: key})
+}
+
+// Fetch retrieves the file described by req from the sources the Getter's Strategy picks, in the order of
+// req.Sources when it has any. By default that is
+// the remote file system when it is configured and req has a complete remote location, falling back to
+// req.LocalPath otherwise.
+// An invalid req is reported without touching either file system.
+// Errors are *FetchError, apart from ctx.Err() which is returned as is.
+func (g *Getter) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, Source, error) {
+	res, err := g.fetchObject(ctx, req)
+	if err != nil {
+		return nil, res.Source, err
+	}
+	return res.Body, res.Source, nil
+}
+
+// fetch does the work of Fetch, returning the file exactly as the backend that served it handed it over.
+// The result is never nil, on error it only says which source failed.
+func (g *Getter) fetch(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	if err := g.validate(req); err != nil {
+		return &FetchResult{}, err
+	}
 
-		g.logger.Printf("falling back to local source - %v", err)
-	} else if g.useRemoteFS {
-		// we want to do remote fs stuff, but host, bucket, or key are messed up
-		g.logger.Printf(`falling back to local source - missing fields. "host":%q, "bucket":%q, "key":%q`, host, bucket, key)
+	if len(req.Sources) > 0 {
+		names := make([]string, len(req.Sources))
+		for i, s := range req.Sources {
+			names[i] = string(s)
+		}
+		return g.fetchChain(ctx, req, names)
+	}
+	if g.backendChain == nil && g.strategy == Hedged && !req.namesArchiveMember() {
+		return g.fetchHedged(ctx, req)
 	}
+	return g.fetchChain(ctx, req, g.chain())
+}
 
-	fh, err := g.localFetcher.Open(localPath)
+// openLocal opens the local file of req
+func (g *Getter) openLocal(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	fh, info, err := g.local.Fetch(ctx, req)
 	if err != nil {
-		return nil, Local, err
+		if isContextErr(err) {
+			return &FetchResult{Source: Local}, err
+		}
+		return &FetchResult{Source: Local}, newFetchError(Local, req, err)
 	}
 
-	return fh, Local, nil
+	return &FetchResult{Body: fh, Source: Local, ObjectInfo: info}, nil
 }
 
-type remoteFetcher interface {
-	FetchRemoteFile(accessKey, accessSecret, host, bucket, key string) (io.ReadCloser, error)
+// minioWrapper is the built in remote Backend
+type minioWrapper struct {
+	clients *clientPool
+	creds   *credentials.Credentials
+	// keys supplies SSE-C keys, nil when objects are not encrypted with customer keys
+	keys KeyProvider
+	// secure is set when requests go over HTTPS, which SSE-C keys must
+	secure bool
 }
 
-// minioWrapper adheres to the remoteFetcher interface
-type minioWrapper struct{}
+// Name returns the name of the remote backend
+func (m *minioWrapper) Name() string {
+	return string(Remote)
+}
 
-// FetchRemoteFile returns a remote file
-func (*minioWrapper) FetchRemoteFile(accessKey, accessSecret, host, bucket, key string) (io.ReadCloser, error) {
-	client, err := minio.NewV2(host, accessKey, accessSecret, false)
+// Fetch returns a remote file along with its info
+func (m *minioWrapper) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	creds := m.creds
+	client, err := m.clients.get(req.Host, creds)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to get remote fs client")
+		return nil, ObjectInfo{}, errors.Wrap(err, "unable to get remote fs client")
 	}
 
-	obj, err := client.GetObject(bucket, key)
+	sse, err := serverSideEncryption(ctx, m.keys, m.secure, req)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to get remote object")
+		return nil, ObjectInfo{}, err
+	}
+	opts := minio.GetObjectOptions{ServerSideEncryption: sse}
+	if req.Range != nil {
+		if err := req.Range.setRange(&opts); err != nil {
+			return nil, ObjectInfo{}, errors.Wrap(err, "unable to set remote range")
+		}
 	}
-	_, err = obj.Stat()
+
+	obj, err := client.GetObjectWithContext(ctx, req.Bucket, req.Key, opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to get remote file info")
+		return nil, ObjectInfo{}, errors.Wrap(singleAttemptCause(err), "unable to get remote object")
 	}
 
-	return obj, nil
+	if req.Range != nil {
+		fh, info, err := fetchRemoteRange(obj)
+		if err != nil {
+			err = singleAttemptCause(err)
+			expireOnAuthError(creds, err)
+			return nil, ObjectInfo{}, errors.Wrap(err, "unable to get remote range")
+		}
+		return fh, objectInfoFromMinio(info), nil
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		err = singleAttemptCause(err)
+		expireOnAuthError(creds, err)
+		return nil, ObjectInfo{}, errors.Wrap(err, "unable to get remote file info")
+	}
+
+	return obj, objectInfoFromMinio(info), nil
 }
 
-type localFetcher interface {
-	Open(localPath string) (io.ReadCloser, error)
+// Stat returns the info of a remote file without reading it
+func (m *minioWrapper) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	creds := m.creds
+	client, err := m.clients.get(req.Host, creds)
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(err, "unable to get remote fs client")
+	}
+
+	sse, err := serverSideEncryption(ctx, m.keys, m.secure, req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// the object is only read from if we ask it to, so a stat of it is a HEAD request bound to ctx
+	obj, err := client.GetObjectWithContext(ctx, req.Bucket, req.Key, minio.GetObjectOptions{ServerSideEncryption: sse})
+	if err != nil {
+		return ObjectInfo{}, errors.Wrap(singleAttemptCause(err), "unable to get remote object")
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		err = singleAttemptCause(err)
+		expireOnAuthError(creds, err)
+		return ObjectInfo{}, errors.Wrap(err, "unable to get remote file info")
+	}
+	return objectInfoFromMinio(info), nil
 }
 
-// osFile adheres to the localFetcher interface
+// osFile is the built in local Backend
 type osFile struct{}
 
-// Open opens a local file
-func (f *osFile) Open(localPath string) (io.ReadCloser, error) {
-	return os.Open(localPath)
+// Name returns the name of the local backend
+func (f *osFile) Name() string {
+	return string(Local)
+}
+
+// Fetch opens the local file at req.LocalPath, limited to req.Range when one is set
+func (f *osFile) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	fh, err := os.Open(req.LocalPath)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if req.Range == nil {
+		return fh, objectInfoFromFile(info, info.Size()), nil
+	}
+
+	start, length, err := req.Range.bounds(info.Size())
+	if err != nil {
+		fh.Close()
+		return nil, ObjectInfo{}, err
+	}
+	section := &sectionFile{SectionReader: io.NewSectionReader(fh, start, length), Closer: fh}
+	return section, objectInfoFromFile(info, length), nil
+}
+
+// Stat returns the info of the local file at req.LocalPath
+func (f *osFile) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(req.LocalPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return objectInfoFromFile(info, info.Size()), nil
 }
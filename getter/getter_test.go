@@ -2,6 +2,7 @@ package getter
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -126,18 +127,74 @@ func TestGetFile(t *testing.T) {
 			expectedErr:    nil,
 			expectedLogs:   []string{"falling back to local source - missing fields", `"bucket":"bucket"`, `"key":"key"`, `"host":""`},
 		},
+		{
+			name:           "malformed bucket, local fs, open local",
+			useRemoteFS:    false,
+			data:           []byte("file data"),
+			bucket:         "ab",
+			key:            "key",
+			host:           "host",
+			expectedSource: Local,
+			remoteErr:      nil,
+			localErr:       nil,
+			expectedErr:    nil,
+		},
+		{
+			name:           "malformed bucket, remote fs, use local",
+			useRemoteFS:    true,
+			data:           []byte("file data"),
+			bucket:         "ab",
+			key:            "key",
+			host:           "host",
+			expectedSource: Local,
+			remoteErr:      nil,
+			localErr:       nil,
+			expectedErr:    nil,
+			expectedLogs:   []string{"falling back to local source - invalid remote location", `"ab"`},
+		},
+		{
+			name:           "malformed host, local fs, open local",
+			useRemoteFS:    false,
+			data:           []byte("file data"),
+			bucket:         "bucket",
+			key:            "key",
+			host:           "http://host",
+			expectedSource: Local,
+			remoteErr:      nil,
+			localErr:       nil,
+			expectedErr:    nil,
+		},
+		{
+			name:           "malformed host, remote fs, use local",
+			useRemoteFS:    true,
+			data:           []byte("file data"),
+			bucket:         "bucket",
+			key:            "key",
+			host:           "http://host",
+			expectedSource: Local,
+			remoteErr:      nil,
+			localErr:       nil,
+			expectedErr:    nil,
+			expectedLogs:   []string{"falling back to local source - invalid remote location", `"http://host"`},
+		},
 	} {
 		t.Run(fmt.Sprintf("%s", test.name), func(t *testing.T) {
 			// Set up and call GetFile
 			logBuf := &bytes.Buffer{}
 			fetcher := New(log.New(logBuf, "test", log.LstdFlags), test.useRemoteFS, "accesskey", "accesssecret")
-			fetcher.remoteFetcher = &fakeRemote{data: test.data, err: test.remoteErr}
-			fetcher.localFetcher = &fakeLocal{data: test.data, err: test.localErr}
+			fetcher.remote = &fakeRemote{data: test.data, err: test.remoteErr}
+			fetcher.local = &fakeLocal{data: test.data, err: test.localErr}
 			fh, source, err := fetcher.FetchFile("localpath", test.host, test.bucket, test.key)
 
 			// make sure that everything was as expected
 			assert.Equal(t, test.expectedSource, source)
-			assert.Equal(t, test.expectedErr, err)
+			if fetchErr, ok := err.(*FetchError); ok {
+				// compare against the underlying error from the fake
+				assert.Equal(t, test.expectedSource, fetchErr.Source)
+				assert.Equal(t, test.expectedErr, fetchErr.Err)
+			} else {
+				assert.Equal(t, test.expectedErr, err)
+			}
 
 			for _, expected := range test.expectedLogs {
 				assert.Contains(t, logBuf.String(), expected)
@@ -157,20 +214,64 @@ func TestGetFile(t *testing.T) {
 	}
 }
 
+// TestFetchFileContextCancelled verifies that a cancelled context is reported as is and never falls back to local
+func TestFetchFileContextCancelled(t *testing.T) {
+	logBuf := &bytes.Buffer{}
+	fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "accesskey", "accesssecret")
+	local := &fakeLocal{data: []byte("file data")}
+	fetcher.remote = &fakeRemote{err: context.Canceled}
+	fetcher.local = local
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fh, source, err := fetcher.FetchFileContext(ctx, "localpath", "host", "bucket", "key")
+
+	assert.Nil(t, fh)
+	assert.Equal(t, Remote, source)
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, local.opened, "local file should not be opened once the context is done")
+	assert.NotContains(t, logBuf.String(), "falling back to local source")
+}
+
+// discardLogger returns a logger for tests that do not inspect log output
+func discardLogger() *log.Logger {
+	return log.New(ioutil.Discard, "test", log.LstdFlags)
+}
+
 type fakeRemote struct {
-	data []byte
-	err  error
+	data    []byte
+	err     error
+	fetched bool
+}
+
+func (f *fakeRemote) Name() string {
+	return string(Remote)
 }
 
-func (f *fakeRemote) FetchRemoteFile(accessKey, accessSecret, host, bucket, key string) (io.ReadCloser, error) {
-	return ioutil.NopCloser(bytes.NewReader(f.data)), f.err
+func (f *fakeRemote) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	f.fetched = true
+	return ioutil.NopCloser(bytes.NewReader(f.data)), ObjectInfo{Size: int64(len(f.data))}, f.err
+}
+
+func (f *fakeRemote) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(f.data))}, f.err
 }
 
 type fakeLocal struct {
-	data []byte
-	err  error
+	data   []byte
+	err    error
+	opened bool
+}
+
+func (f *fakeLocal) Name() string {
+	return string(Local)
+}
+
+func (f *fakeLocal) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	f.opened = true
+	return ioutil.NopCloser(bytes.NewReader(f.data)), ObjectInfo{Size: int64(len(f.data))}, f.err
 }
 
-func (f *fakeLocal) Open(localPath string) (io.ReadCloser, error) {
-	return ioutil.NopCloser(bytes.NewReader(f.data)), f.err
+func (f *fakeLocal) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(f.data))}, f.err
 }
@@ -0,0 +1,224 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Hedged fetches remotely and, if the remote file has not produced its first byte within the hedge delay,
+// opens the local file as well, returning whichever responds first. See WithHedging.
+const Hedged Strategy = "hedged"
+
+// DefaultHedgeDelay is how long the Hedged strategy waits for the remote file before opening the local one
+// unless told otherwise
+const DefaultHedgeDelay = 100 * time.Millisecond
+
+// WithHedging uses the Hedged strategy, opening the local file when the remote one has not produced its first
+// byte within delay. The slower source is closed, and the Source of the result says which one won.
+func WithHedging(delay time.Duration) Option {
+	return func(g *Getter) {
+		g.strategy = Hedged
+		g.hedgeDelay = delay
+	}
+}
+
+// hedgeResult is what one side of a hedged fetch came back with
+type hedgeResult struct {
+	res *FetchResult
+	err error
+}
+
+// fetchHedged races the remote file of req against its local file, giving the remote file a head start of
+// the hedge delay
+func (g *Getter) fetchHedged(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	if req.LocalPath == "" || !g.hasRemote(req) {
+		// there is nothing to race
+		return g.fetchChain(ctx, req, RemoteFirst.chain())
+	}
+
+	// the remote fetch is cancelled when it loses, or once its body is closed when it wins
+	remoteCtx, cancelRemote := context.WithCancel(ctx)
+	remote := make(chan hedgeResult, 1)
+	go func() {
+		res, err := g.fetchRemoteEndpoints(remoteCtx, req)
+		if err == nil {
+			res.Body, err = peekFirstByte(res.Body)
+		}
+		if err != nil {
+			remote <- hedgeResult{res: &FetchResult{Source: Remote}, err: err}
+			return
+		}
+		res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancelRemote}
+		remote <- hedgeResult{res: res}
+	}()
+
+	delay := g.hedgeDelay
+	if delay <= 0 {
+		delay = DefaultHedgeDelay
+	}
+	var local chan hedgeResult
+	startLocal := func() {
+		local = make(chan hedgeResult, 1)
+		go func() {
+			res, err := g.openLocal(ctx, req)
+			if err == nil {
+				res.Body, err = peekFirstByte(res.Body)
+			}
+			local <- hedgeResult{res: res, err: err}
+		}()
+	}
+
+	hedge := g.clock.After(delay)
+	var remoteErr, localErr error
+	// one of the sides is always running until the loop returns, the local side is started at most once
+	for remote != nil || local != nil {
+		select {
+		case r := <-remote:
+			remote = nil
+			if r.err == nil {
+				g.abandonHedge(local)
+				return r.res, nil
+			}
+			if isContextErr(r.err) && ctx.Err() != nil {
+				g.abandonHedge(local)
+				return &FetchResult{Source: Remote}, ctx.Err()
+			}
+			remoteErr = r.err
+			if local == nil && localErr == nil {
+				g.logger.Printf("falling back to local source - %v", r.err)
+				startLocal()
+			}
+		case r := <-local:
+			local = nil
+			if r.err == nil {
+				cancelRemote()
+				g.abandonHedge(remote)
+				return r.res, nil
+			}
+			localErr = r.err
+		case <-hedge:
+			hedge = nil
+			if local == nil && remoteErr == nil {
+				g.logger.Printf("hedging remote fetch with local source after %v", delay)
+				startLocal()
+			}
+		case <-ctx.Done():
+			cancelRemote()
+			g.abandonHedge(remote)
+			g.abandonHedge(local)
+			return &FetchResult{Source: Remote}, ctx.Err()
+		}
+	}
+
+	// both failed, like RemoteFirst the local error is the one reported
+	cancelRemote()
+	return &FetchResult{Source: Local}, localErr
+}
+
+// abandonHedge closes whatever the losing side of a hedged fetch comes back with
+func (g *Getter) abandonHedge(results <-chan hedgeResult) {
+	if results == nil {
+		return
+	}
+	go func() {
+		if r := <-results; r.err == nil {
+			r.res.Body.Close()
+		}
+	}()
+}
+
+// cancelOnClose cancels the context of a fetch once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body, then cancels its context
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// unwrap returns the body
+func (c *cancelOnClose) unwrap() io.ReadCloser {
+	return c.ReadCloser
+}
+
+// Seek seeks the body if it supports seeking
+func (c *cancelOnClose) Seek(offset int64, whence int) (int64, error) {
+	s, ok := c.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("file does not support seeking")
+	}
+	return s.Seek(offset, whence)
+}
+
+// ReadAt reads from the body at off if it supports it
+func (c *cancelOnClose) ReadAt(p []byte, off int64) (int, error) {
+	r, ok := c.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("file does not support reading at an offset")
+	}
+	return r.ReadAt(p, off)
+}
+
+// peekFirstByte waits for the first byte of rc, returning a reader that still starts with it.
+// An empty file counts as having responded. rc is closed if it fails.
+func peekFirstByte(rc io.ReadCloser) (io.ReadCloser, error) {
+	p := &peekedFile{ReadCloser: rc}
+	n, err := io.ReadFull(rc, p.first[:])
+	p.pending = n
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// peekedFile is a file whose first byte has already been read
+type peekedFile struct {
+	io.ReadCloser
+	first   [1]byte
+	pending int
+}
+
+// Read returns the peeked byte, then the rest of the file
+func (p *peekedFile) Read(b []byte) (int, error) {
+	if p.pending > 0 && len(b) > 0 {
+		b[0] = p.first[0]
+		p.pending = 0
+		return 1, nil
+	}
+	return p.ReadCloser.Read(b)
+}
+
+// unwrap returns the file
+func (p *peekedFile) unwrap() io.ReadCloser {
+	return p.ReadCloser
+}
+
+// Seek seeks the file if it supports seeking, accounting for the peeked byte
+func (p *peekedFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := p.ReadCloser.(io.Seeker)
+	if !ok {
+		return 0, errors.New("file does not support seeking")
+	}
+	if whence == io.SeekCurrent {
+		offset -= int64(p.pending)
+	}
+	p.pending = 0
+	return s.Seek(offset, whence)
+}
+
+// ReadAt reads from the file at off if it supports it
+func (p *peekedFile) ReadAt(b []byte, off int64) (int, error) {
+	r, ok := p.ReadCloser.(io.ReaderAt)
+	if !ok {
+		return 0, errors.New("file does not support reading at an offset")
+	}
+	return r.ReadAt(b, off)
+}
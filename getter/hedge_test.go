@@ -0,0 +1,189 @@
+package getter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor polls cond until it holds, failing the test if it never does
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+// TestFetchHedged verifies that the local file is raced against a slow remote file, the first to respond winning
+func TestFetchHedged(t *testing.T) {
+	tests := []struct {
+		name string
+		// hedge fires the hedge delay straight away, otherwise it never fires
+		hedge bool
+		// remoteReady lets the remote fetch through, otherwise it waits until it is cancelled
+		remoteReady    bool
+		remoteErr      error
+		localErr       error
+		expectedSource Source
+		// expectedErr is the Source of the expected FetchError, empty for success
+		expectedErr       Source
+		expectedLocal     bool
+		expectedCancelled bool
+	}{
+		{name: "remote before the delay", remoteReady: true, expectedSource: Remote},
+		{name: "remote fails before the delay", remoteReady: true, remoteErr: errNoSuchKey, expectedSource: Local, expectedLocal: true},
+		{name: "local wins after the delay", hedge: true, expectedSource: Local, expectedLocal: true, expectedCancelled: true},
+		{name: "both fail", hedge: true, remoteReady: true, remoteErr: errNoSuchKey, localErr: os.ErrNotExist, expectedErr: Local, expectedLocal: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			clock.block = !test.hedge
+			remote := newGatedRemote([]byte("remote data"), test.remoteErr)
+			if test.remoteReady {
+				close(remote.release)
+			}
+			local := &fakeLocal{data: []byte("local data"), err: test.localErr}
+			fetcher := New(discardLogger(), true, "key", "secret", WithHedging(time.Second), WithClock(clock))
+			fetcher.remote = remote
+			fetcher.local = local
+
+			fh, source, err := fetcher.Fetch(context.Background(), FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"})
+			assert.Equal(t, []time.Duration{time.Second}, clock.waits)
+			if test.expectedErr != "" {
+				var fetchErr *FetchError
+				require.True(t, errors.As(err, &fetchErr), "got %v", err)
+				assert.Equal(t, test.expectedErr, fetchErr.Source)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedSource, source)
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, string(test.expectedSource)+" data", string(body), "the peeked byte is not lost")
+			require.NoError(t, fh.Close())
+			assert.Equal(t, test.expectedLocal, local.opened)
+			if test.expectedCancelled {
+				waitFor(t, func() bool { return atomic.LoadInt32(&remote.cancelled) == 1 }, "the losing remote fetch was not cancelled")
+			}
+		})
+	}
+}
+
+// notifyingLocal is a fakeLocal that closes opened when it is opened
+type notifyingLocal struct {
+	fakeLocal
+	opened chan struct{}
+}
+
+func (f *notifyingLocal) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	close(f.opened)
+	return f.fakeLocal.Fetch(ctx, req)
+}
+
+// TestFetchHedgedLocalFails verifies that a slow remote file still wins when the local file fails
+func TestFetchHedgedLocalFails(t *testing.T) {
+	remote := newGatedRemote([]byte("remote data"), nil)
+	local := &notifyingLocal{fakeLocal: fakeLocal{err: os.ErrNotExist}, opened: make(chan struct{})}
+	fetcher := New(discardLogger(), true, "key", "secret", WithHedging(time.Second), WithClock(newFakeClock()))
+	fetcher.remote = remote
+	fetcher.local = local
+	go func() {
+		<-local.opened
+		close(remote.release)
+	}()
+
+	fh, source, err := fetcher.Fetch(context.Background(), FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"})
+	require.NoError(t, err)
+	defer fh.Close()
+	assert.Equal(t, Remote, source)
+	body, err := ioutil.ReadAll(fh)
+	require.NoError(t, err)
+	assert.Equal(t, "remote data", string(body))
+}
+
+// TestFetchHedgedLoserClosed verifies that a source which responds after the winner is closed
+func TestFetchHedgedLoserClosed(t *testing.T) {
+	clock := newFakeClock()
+	remote := newGatedRemote([]byte("remote data"), nil)
+	fetcher := New(discardLogger(), true, "key", "secret", WithStrategy(Hedged), WithClock(clock))
+	fetcher.remote = remote
+	fetcher.local = &fakeLocal{data: []byte("local data")}
+
+	// the remote fetch is held up, so local wins once the hedge fires
+	fh, source, err := fetcher.Fetch(context.Background(), FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"})
+	require.NoError(t, err)
+	fh.Close()
+	assert.Equal(t, Local, source)
+	assert.Equal(t, []time.Duration{DefaultHedgeDelay}, clock.waits)
+
+	close(remote.release)
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&remote.cancelled)+atomic.LoadInt32(&remote.closes) == 1
+	}, "the losing remote fetch was neither cancelled nor closed")
+}
+
+// TestFetchHedgedCancelled verifies that cancelling a hedged fetch gives up on both sources
+func TestFetchHedgedCancelled(t *testing.T) {
+	clock := newFakeClock()
+	clock.block = true
+	remote := newGatedRemote([]byte("remote data"), nil)
+	fetcher := New(discardLogger(), true, "key", "secret", WithHedging(time.Second), WithClock(clock))
+	fetcher.remote = remote
+	fetcher.local = &fakeLocal{data: []byte("local data")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitFor(t, func() bool { return atomic.LoadInt32(&remote.calls) == 1 }, "the remote fetch never started")
+		cancel()
+	}()
+	_, _, err := fetcher.Fetch(ctx, FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"})
+	assert.Equal(t, context.Canceled, err)
+	waitFor(t, func() bool { return atomic.LoadInt32(&remote.cancelled) == 1 }, "the remote fetch was not cancelled")
+}
+
+// TestFetchHedgedSeekable verifies that hedged results can still be seeked
+func TestFetchHedgedSeekable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("local data"), 0600))
+
+	remote := newGatedRemote([]byte("remote data"), nil)
+	fetcher := New(discardLogger(), true, "key", "secret", WithHedging(time.Second), WithClock(newFakeClock()))
+	fetcher.remote = remote
+
+	rs, source, err := fetcher.FetchSeekable(context.Background(), FetchRequest{LocalPath: path, Host: "host", Bucket: "bucket", Key: "key"})
+	require.NoError(t, err)
+	defer rs.Close()
+	assert.Equal(t, Local, source)
+
+	pos, err := rs.Seek(1, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pos, "the peeked byte counts as unread")
+	body, err := ioutil.ReadAll(rs)
+	require.NoError(t, err)
+	assert.Equal(t, "ocal data", string(body))
+
+	_, err = rs.Seek(-4, io.SeekEnd)
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(rs)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(body))
+}
@@ -0,0 +1,285 @@
+package getter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HTTP is the Source of files served by the built in HTTP backend from FetchRequest.URL
+const HTTP Source = "http"
+
+// DefaultHTTPMaxRedirects is how many redirects the HTTP backend follows unless told otherwise
+const DefaultHTTPMaxRedirects = 10
+
+// ErrTooLarge is reported for files larger than the HTTP backend is allowed to fetch
+var ErrTooLarge = errors.New("file is larger than allowed")
+
+// HTTPSettings configures the built in HTTP backend. The zero value follows DefaultHTTPMaxRedirects
+// redirects and fetches files of any size.
+type HTTPSettings struct {
+	// MaxRedirects is how many redirects are followed, DefaultHTTPMaxRedirects when zero and none when negative
+	MaxRedirects int
+	// MaxSize is the largest file fetched in bytes, reported as ErrTooLarge. Zero or less allows any size.
+	MaxSize int64
+	// TLSConfig configures HTTPS requests for URLs, which are verified against the system roots when nil
+	TLSConfig *tls.Config
+}
+
+// WithHTTPSettings configures the built in HTTP backend. TLS settings of the remote file system such as
+// WithRootCAs and WithClientCertificate do not apply to it, s.TLSConfig does.
+func WithHTTPSettings(s HTTPSettings) Option {
+	return func(g *Getter) {
+		g.httpSettings = s
+	}
+}
+
+// HTTPError is a response from an HTTP server that did not carry the file
+type HTTPError struct {
+	// URL is the URL that was requested, redacted of its query and user info
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+// Error describes the response
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status %q from %s", e.Status, e.URL)
+}
+
+// redactURL strips the parts of rawURL that may hold credentials, such as signed query strings
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<unparseable url>"
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
+
+// validateURL reports whether rawURL is an absolute http or https URL
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Errorf("url %q cannot be parsed", redactURL(rawURL))
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("url %q must be http or https", redactURL(rawURL))
+	}
+	if u.Host == "" {
+		return errors.Errorf("url %q has no host", redactURL(rawURL))
+	}
+	return nil
+}
+
+// urlHost returns the host[:port] of rawURL, for retries and circuit breakers
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// httpBackend is the built in Backend fetching http and https URLs
+type httpBackend struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// newHTTPBackend creates the HTTP backend, sending requests through transport, or http.DefaultTransport when nil
+func newHTTPBackend(s HTTPSettings, transport http.RoundTripper) *httpBackend {
+	maxRedirects := s.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultHTTPMaxRedirects
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errors.Errorf("stopped after %d redirects", len(via)-1)
+			}
+			return nil
+		},
+	}
+	return &httpBackend{client: client, maxSize: s.MaxSize}
+}
+
+// Name returns the name of the HTTP backend
+func (b *httpBackend) Name() string {
+	return string(HTTP)
+}
+
+// Fetch GETs req.URL, limited to req.Range when one is set
+func (b *httpBackend) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	header := http.Header{}
+	if req.Range != nil {
+		if r := req.Range.httpHeader(); r != "" {
+			header.Set("Range", r)
+		}
+	}
+	resp, err := b.do(ctx, http.MethodGet, req.URL, header)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	info := objectInfoFromHTTP(resp)
+	var body io.ReadCloser = resp.Body
+	if req.Range != nil && resp.StatusCode == http.StatusOK && header.Get("Range") != "" {
+		// the server ignored the range, so skip to it ourselves
+		if body, info.Size, err = skipToRange(resp.Body, *req.Range, resp.ContentLength); err != nil {
+			resp.Body.Close()
+			return nil, ObjectInfo{}, errors.Wrap(err, "unable to read range the server ignored")
+		}
+	}
+
+	if b.maxSize > 0 {
+		if info.Size > b.maxSize {
+			body.Close()
+			return nil, ObjectInfo{}, errors.Wrapf(ErrTooLarge, "%d bytes, the limit is %d", info.Size, b.maxSize)
+		}
+		body = &capReader{ReadCloser: body, remaining: b.maxSize}
+	}
+	return body, info, nil
+}
+
+// skipToRange reads body up to where r starts and limits it to the bytes r covers. size is -1 when the server
+// did not say how large the file is, in which case the range is streamed and its size is unknown too.
+func skipToRange(body io.ReadCloser, r ByteRange, size int64) (io.ReadCloser, int64, error) {
+	if size >= 0 {
+		start, length, err := r.bounds(size)
+		if err != nil {
+			return nil, 0, requestError{err}
+		}
+		if _, err := io.CopyN(ioutil.Discard, body, start); err != nil {
+			return nil, 0, err
+		}
+		return readCloser{Reader: io.LimitReader(body, length), Closer: body}, length, nil
+	}
+
+	if r.Offset < 0 {
+		return nil, 0, requestError{errors.Errorf("suffix range of %d bytes needs the size of the file, which the server did not send", -r.Offset)}
+	}
+	buffered := bufio.NewReader(body)
+	if _, err := io.CopyN(ioutil.Discard, buffered, r.Offset); err != nil {
+		if err == io.EOF {
+			return nil, 0, requestError{errors.Errorf("range offset %d is beyond the end of the file", r.Offset)}
+		}
+		return nil, 0, err
+	}
+	if _, err := buffered.Peek(1); err == io.EOF && r.Offset > 0 {
+		return nil, 0, requestError{errors.Errorf("range offset %d is beyond the end of the file (%d bytes)", r.Offset, r.Offset)}
+	} else if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	var limited io.Reader = buffered
+	if r.Length > 0 {
+		limited = io.LimitReader(buffered, r.Length)
+	}
+	return readCloser{Reader: limited, Closer: body}, -1, nil
+}
+
+// Stat HEADs req.URL
+func (b *httpBackend) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	resp, err := b.do(ctx, http.MethodHead, req.URL, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return objectInfoFromHTTP(resp), nil
+}
+
+// do sends a request, turning responses that do not carry the file into an *HTTPError
+func (b *httpBackend) do(ctx context.Context, method, rawURL string, header http.Header) (*http.Response, error) {
+	httpReq, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create http request")
+	}
+	for k, v := range header {
+		httpReq.Header[k] = v
+	}
+
+	resp, err := b.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if urlErr, ok := err.(*url.Error); ok {
+			// the URL may be signed, keep its query out of logs
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &HTTPError{URL: redactURL(rawURL), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// objectInfoFromHTTP converts what an HTTP server told us about a file
+func objectInfoFromHTTP(resp *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Size:            resp.ContentLength,
+		ETag:            resp.Header.Get("ETag"),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		Metadata:        map[string]string{},
+	}
+	if !strings.HasPrefix(info.ETag, "W/") {
+		// weak ETags keep their marker so they are never mistaken for a checksum
+		info.ETag = strings.Trim(info.ETag, `"`)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	return info
+}
+
+// httpHeader returns the Range header asking for the range, empty for the whole file
+func (r ByteRange) httpHeader() string {
+	switch {
+	case r.Offset < 0:
+		return "bytes=" + strconv.FormatInt(r.Offset, 10)
+	case r.Length > 0:
+		return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+	case r.Offset > 0:
+		return fmt.Sprintf("bytes=%d-", r.Offset)
+	}
+	return ""
+}
+
+// capReader fails with ErrTooLarge once more than the allowed number of bytes have been read, for responses
+// that did not say how large they are
+type capReader struct {
+	io.ReadCloser
+	remaining int64
+	// err is set once the cap has been hit, every read after that fails with it
+	err error
+}
+
+// Read reads from the response, failing once it goes past the cap
+func (c *capReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.ReadCloser.Read(p)
+	if int64(n) > c.remaining {
+		n, c.remaining, c.err = int(c.remaining), 0, ErrTooLarge
+		return n, c.err
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,377 @@
+package getter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// httpModTime is the Last-Modified time of files served by newHTTPServer
+var httpModTime = time.Date(2018, time.April, 2, 8, 0, 0, 0, time.UTC)
+
+// newHTTPServer serves data at /mail.eml with http.ServeContent, so ranges and conditional requests work,
+// and counts the requests it gets. The caller must Close it.
+func newHTTPServer(data []byte, requests *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		if r.URL.Path != "/mail.eml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "message/rfc822")
+		http.ServeContent(w, r, "", httpModTime, bytes.NewReader(data))
+	}))
+}
+
+// TestFetchHTTP verifies that URLs are fetched with their metadata, whole or in part
+func TestFetchHTTP(t *testing.T) {
+	data := []byte("Subject: hello\r\n\r\nbody")
+	var requests int64
+	srv := newHTTPServer(data, &requests)
+	defer srv.Close()
+
+	// ignoring serves the whole file whatever the Range header says
+	ignoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data)
+	}))
+	defer ignoring.Close()
+
+	// streaming ignores the Range header and never says how large the file is
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data[:5])
+		w.(http.Flusher).Flush()
+		w.Write(data[5:])
+	}))
+	defer streaming.Close()
+
+	for _, test := range []struct {
+		name         string
+		url          string
+		rng          *ByteRange
+		expectedData []byte
+		unknownSize  bool
+		expectedErr  string
+	}{
+		{name: "whole file", url: srv.URL + "/mail.eml", expectedData: data},
+		{name: "range", url: srv.URL + "/mail.eml", rng: &ByteRange{Offset: 2, Length: 5}, expectedData: data[2:7]},
+		{name: "suffix range", url: srv.URL + "/mail.eml", rng: &ByteRange{Offset: -4}, expectedData: data[len(data)-4:]},
+		{name: "open range", url: srv.URL + "/mail.eml", rng: &ByteRange{Offset: 9}, expectedData: data[9:]},
+		{name: "range ignored by server", url: ignoring.URL + "/mail.eml", rng: &ByteRange{Offset: 2, Length: 5}, expectedData: data[2:7]},
+		{name: "suffix range ignored by server", url: ignoring.URL + "/mail.eml", rng: &ByteRange{Offset: -4}, expectedData: data[len(data)-4:]},
+		{name: "range ignored by streaming server", url: streaming.URL + "/mail.eml", rng: &ByteRange{Offset: 2, Length: 5}, expectedData: data[2:7], unknownSize: true},
+		{name: "open range ignored by streaming server", url: streaming.URL + "/mail.eml", rng: &ByteRange{Offset: 9}, expectedData: data[9:], unknownSize: true},
+		{name: "suffix range ignored by streaming server", url: streaming.URL + "/mail.eml", rng: &ByteRange{Offset: -4}, expectedErr: "needs the size of the file"},
+		{name: "offset past the end of streamed file", url: streaming.URL + "/mail.eml", rng: &ByteRange{Offset: 100}, expectedErr: "beyond the end of the file"},
+		{name: "offset at the end of streamed file", url: streaming.URL + "/mail.eml", rng: &ByteRange{Offset: int64(len(data))}, expectedErr: "beyond the end of the file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret")
+			res, err := fetcher.FetchObject(context.Background(), FetchRequest{URL: test.url, Range: test.rng})
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, body)
+			assert.Equal(t, HTTP, res.Source)
+			if test.unknownSize {
+				assert.Equal(t, int64(-1), res.Size)
+			} else {
+				assert.Equal(t, int64(len(test.expectedData)), res.Size)
+			}
+			assert.Equal(t, strings.TrimPrefix(test.url[:strings.LastIndex(test.url, "/")], "http://"), res.Host)
+		})
+	}
+
+	fetcher := New(discardLogger(), true, "key", "secret")
+	res, err := fetcher.FetchObject(context.Background(), FetchRequest{URL: srv.URL + "/mail.eml"})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "v1", res.ETag)
+	assert.Equal(t, "message/rfc822", res.ContentType)
+	assert.True(t, httpModTime.Equal(res.LastModified))
+}
+
+// TestFetchHTTPErrors verifies that failed responses are classified, retried when transient, and fall back
+// to the local file
+func TestFetchHTTPErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(localPath, []byte("local data"), 0600))
+
+	var unavailable int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.eml":
+			if atomic.AddInt64(&unavailable, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, "remote data")
+		case "/private.eml":
+			w.WriteHeader(http.StatusForbidden)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		name           string
+		req            FetchRequest
+		expectedData   string
+		expectedSource Source
+		expectedKind   error
+		expectedErr    string
+	}{
+		{name: "retried", req: FetchRequest{URL: srv.URL + "/flaky.eml"}, expectedData: "remote data", expectedSource: HTTP},
+		{name: "not found", req: FetchRequest{URL: srv.URL + "/missing.eml?sig=s3cr3t"}, expectedSource: HTTP, expectedKind: ErrNotFound, expectedErr: `"url":"` + srv.URL + `/missing.eml"`},
+		{name: "access denied", req: FetchRequest{URL: srv.URL + "/private.eml"}, expectedSource: HTTP, expectedKind: ErrAccessDenied},
+		{name: "redirect loop", req: FetchRequest{URL: srv.URL + "/loop"}, expectedSource: HTTP, expectedErr: "stopped after 3 redirects"},
+		{name: "local fallback", req: FetchRequest{URL: srv.URL + "/missing.eml", LocalPath: localPath}, expectedData: "local data", expectedSource: Local},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt64(&unavailable, 0)
+			fetcher := New(discardLogger(), true, "key", "secret",
+				WithRetryPolicy(RetryPolicy{MaxAttempts: 2}), WithClock(newFakeClock()), WithHTTPSettings(HTTPSettings{MaxRedirects: 3}))
+			fh, source, err := fetcher.Fetch(context.Background(), test.req)
+			assert.Equal(t, test.expectedSource, source)
+			if test.expectedData == "" {
+				require.Error(t, err)
+				if test.expectedKind != nil {
+					assert.True(t, errors.Is(err, test.expectedKind), "%v", err)
+				}
+				assert.Contains(t, err.Error(), test.expectedErr)
+				assert.NotContains(t, err.Error(), "s3cr3t")
+				return
+			}
+			require.NoError(t, err)
+			defer fh.Close()
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, string(body))
+		})
+	}
+}
+
+// TestFetchHTTPMaxSize verifies that files larger than the cap are refused, whether or not the server says
+// how large they are up front
+func TestFetchHTTPMaxSize(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	var requests int64
+	srv := newHTTPServer(data, &requests)
+	defer srv.Close()
+
+	// chunked never sends a Content-Length
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write(data[:10])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer chunked.Close()
+
+	for _, test := range []struct {
+		name        string
+		url         string
+		rng         *ByteRange
+		maxSize     int64
+		expectedErr bool
+	}{
+		{name: "under the cap", url: srv.URL + "/mail.eml", maxSize: 100},
+		{name: "over the cap", url: srv.URL + "/mail.eml", maxSize: 99, expectedErr: true},
+		{name: "range under the cap", url: srv.URL + "/mail.eml", rng: &ByteRange{Offset: 0, Length: 50}, maxSize: 50},
+		{name: "streamed under the cap", url: chunked.URL, maxSize: 100},
+		{name: "streamed over the cap", url: chunked.URL, maxSize: 99, expectedErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret", WithHTTPSettings(HTTPSettings{MaxSize: test.maxSize}))
+			fh, _, err := fetcher.Fetch(context.Background(), FetchRequest{URL: test.url, Range: test.rng})
+			if err == nil {
+				defer fh.Close()
+				_, err = ioutil.ReadAll(fh)
+			}
+			if test.expectedErr {
+				assert.True(t, errors.Is(err, ErrTooLarge), "%v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestFetchHTTPTLS verifies that URLs are verified against the system roots or the HTTP backend's own TLS
+// settings, never against those of the remote file system, and are not sent its client certificates
+func TestFetchHTTPTLS(t *testing.T) {
+	var peerCerts int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt64(&peerCerts, int64(len(r.TLS.PeerCertificates)))
+		w.Write([]byte("mail data"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	// the untrusted cases fail the handshake, which the server would log
+	srv.Config.ErrorLog = discardLogger()
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	clientCert := selfSignedCert(t)
+
+	for _, test := range []struct {
+		name        string
+		opts        []Option
+		expectedErr bool
+	}{
+		{name: "system roots", expectedErr: true},
+		{name: "remote file system roots", opts: []Option{WithRootCAs(pool)}, expectedErr: true},
+		{name: "http roots", opts: []Option{WithHTTPSettings(HTTPSettings{TLSConfig: &tls.Config{RootCAs: pool}})}},
+		{name: "remote file system client certificate", opts: []Option{WithRootCAs(pool), WithClientCertificate(clientCert),
+			WithHTTPSettings(HTTPSettings{TLSConfig: &tls.Config{RootCAs: pool}})}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt64(&peerCerts, -1)
+			fetcher := New(discardLogger(), true, "key", "secret", test.opts...)
+			fh, _, err := fetcher.Fetch(context.Background(), FetchRequest{URL: srv.URL + "/mail.eml"})
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer fh.Close()
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, "mail data", string(body))
+			assert.Equal(t, int64(0), atomic.LoadInt64(&peerCerts))
+		})
+	}
+}
+
+// TestFetchHTTPCompressed verifies that compressed responses reach the decoder untouched, whichever transport
+// the HTTP backend uses
+func TestFetchHTTPCompressed(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("mail data"))
+	require.NoError(t, zw.Close())
+	var acceptEncoding atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		name             string
+		opts             []Option
+		expectedData     []byte
+		expectedOriginal Encoding
+	}{
+		{name: "untouched", expectedData: gz.Bytes()},
+		{name: "decompressed", opts: []Option{WithDecompression()}, expectedData: []byte("mail data"), expectedOriginal: EncodingGzip},
+		{name: "http tls settings", opts: []Option{WithDecompression(), WithHTTPSettings(HTTPSettings{TLSConfig: &tls.Config{}})},
+			expectedData: []byte("mail data"), expectedOriginal: EncodingGzip},
+		{name: "remote file system tls settings", opts: []Option{WithDecompression(), WithTLSConfig(&tls.Config{})},
+			expectedData: []byte("mail data"), expectedOriginal: EncodingGzip},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret", test.opts...)
+			res, err := fetcher.FetchObject(context.Background(), FetchRequest{URL: srv.URL + "/mail.eml.gz"})
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, body)
+			assert.Equal(t, test.expectedOriginal, res.OriginalEncoding)
+			assert.Equal(t, "", acceptEncoding.Load(), "the transport does not ask for compression itself")
+		})
+	}
+}
+
+// TestCapReader verifies that reads stop at the cap and fail with ErrTooLarge every time after it
+func TestCapReader(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		size         int
+		cap          int64
+		bufSize      int
+		expectedRead int
+		expectedErr  error
+	}{
+		{name: "under the cap", size: 10, cap: 20, bufSize: 4, expectedRead: 10},
+		{name: "at the cap", size: 10, cap: 10, bufSize: 4, expectedRead: 10},
+		{name: "over the cap", size: 30, cap: 10, bufSize: 4, expectedRead: 10, expectedErr: ErrTooLarge},
+		{name: "over the cap in one read", size: 30, cap: 10, bufSize: 64, expectedRead: 10, expectedErr: ErrTooLarge},
+		{name: "zero cap", size: 1, cap: 0, bufSize: 4, expectedErr: ErrTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := &capReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, test.size))), remaining: test.cap}
+			buf := make([]byte, test.bufSize)
+			read := 0
+			var err error
+			for err == nil {
+				var n int
+				n, err = r.Read(buf)
+				require.True(t, n >= 0 && n <= len(buf), "read %d bytes", n)
+				read += n
+			}
+			assert.Equal(t, test.expectedRead, read)
+			if test.expectedErr == nil {
+				assert.Equal(t, io.EOF, err)
+				return
+			}
+			assert.Equal(t, test.expectedErr, err)
+			n, err := r.Read(buf)
+			assert.Equal(t, 0, n)
+			assert.Equal(t, test.expectedErr, err, "the failure sticks")
+		})
+	}
+}
+
+// TestValidateURL verifies that only absolute http and https URLs are accepted
+func TestValidateURL(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		expected bool
+	}{
+		{url: "http://example.com/mail.eml", expected: true},
+		{url: "https://example.com:8443/mail.eml?sig=abc", expected: true},
+		{url: "ftp://example.com/mail.eml", expected: false},
+		{url: "/mail.eml", expected: false},
+		{url: "http:///mail.eml", expected: false},
+		{url: "http://example.com/%zz", expected: false},
+	} {
+		t.Run(test.url, func(t *testing.T) {
+			err := FetchRequest{URL: test.url}.Validate()
+			assert.Equal(t, test.expected, err == nil, "%v", err)
+		})
+	}
+}
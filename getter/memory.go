@@ -0,0 +1,208 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryBackend is a Backend holding files in memory, for tests and fixtures. Files are stored under a key
+// and looked up by the request's "bucket/key", LocalPath or URL, whichever is found first. Latency and errors
+// can be injected to exercise retries and fallbacks. It is safe for concurrent use.
+type MemoryBackend struct {
+	name string
+
+	mu      sync.Mutex
+	files   map[string]memoryFile
+	latency time.Duration
+	// failures are the injected errors, keyed by file key with "" matching every key
+	failures map[string]*memoryFailure
+	fetches  int
+}
+
+// memoryFile is a file stored in a MemoryBackend
+type memoryFile struct {
+	data []byte
+	info ObjectInfo
+}
+
+// memoryFailure is an injected error along with how many more times it is reported, forever when negative
+type memoryFailure struct {
+	err       error
+	remaining int
+}
+
+// NewMemoryBackend creates an empty MemoryBackend called name. Register it with RegisterBackend, or stand it in
+// for a built in backend with WithRemoteBackend or WithLocalBackend.
+func NewMemoryBackend(name string) *MemoryBackend {
+	return &MemoryBackend{name: name, files: map[string]memoryFile{}, failures: map[string]*memoryFailure{}}
+}
+
+// WithRemoteBackend fetches remote files from b instead of the remote file system, such as a MemoryBackend in tests.
+// Retries, circuit breakers, endpoints and the disk cache still apply.
+func WithRemoteBackend(b Backend) Option {
+	return func(g *Getter) {
+		g.remote = b
+	}
+}
+
+// WithLocalBackend opens local files with b instead of the local file system, such as a MemoryBackend in tests
+func WithLocalBackend(b Backend) Option {
+	return func(g *Getter) {
+		g.local = b
+	}
+}
+
+// Name returns the name the backend was created with
+func (m *MemoryBackend) Name() string {
+	return m.name
+}
+
+// Put stores a copy of data under key along with info. info.Size is set to the length of data, and
+// info.ETag to its hex MD5 when empty.
+func (m *MemoryBackend) Put(key string, data []byte, info ObjectInfo) {
+	data = append([]byte{}, data...)
+	info.Size = int64(len(data))
+	if info.ETag == "" {
+		sum := md5.Sum(data)
+		info.ETag = hex.EncodeToString(sum[:])
+	}
+	info.Metadata = copyMetadata(info.Metadata)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[key] = memoryFile{data: data, info: info}
+}
+
+// Delete removes the file stored under key
+func (m *MemoryBackend) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, key)
+}
+
+// SetLatency makes every Fetch and Stat wait d before answering, or until its context is done
+func (m *MemoryBackend) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = d
+}
+
+// InjectError fails the next count fetches and stats of key with err, or all of them when count is zero or less.
+// An empty key fails every key. A nil err removes the injected error.
+func (m *MemoryBackend) InjectError(key string, err error, count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		delete(m.failures, key)
+		return
+	}
+	if count <= 0 {
+		count = -1
+	}
+	m.failures[key] = &memoryFailure{err: err, remaining: count}
+}
+
+// Fetches returns how many times Fetch has been called
+func (m *MemoryBackend) Fetches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fetches
+}
+
+// Fetch returns the file req names, limited to req.Range when one is set. Missing files are ErrNotFound.
+func (m *MemoryBackend) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	m.mu.Lock()
+	m.fetches++
+	m.mu.Unlock()
+
+	file, err := m.lookup(ctx, req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info := file.info
+	info.Metadata = copyMetadata(info.Metadata)
+
+	start, length := int64(0), info.Size
+	if req.Range != nil {
+		if start, length, err = req.Range.bounds(info.Size); err != nil {
+			return nil, ObjectInfo{}, err
+		}
+		info.Size = length
+	}
+	section := io.NewSectionReader(bytes.NewReader(file.data), start, length)
+	return &sectionFile{SectionReader: section, Closer: ioutil.NopCloser(nil)}, info, nil
+}
+
+// Stat returns the info of the file req names
+func (m *MemoryBackend) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	file, err := m.lookup(ctx, req)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := file.info
+	info.Metadata = copyMetadata(info.Metadata)
+	return info, nil
+}
+
+// lookup waits out the latency, then finds the file req names or the error injected for it
+func (m *MemoryBackend) lookup(ctx context.Context, req FetchRequest) (memoryFile, error) {
+	m.mu.Lock()
+	latency := m.latency
+	m.mu.Unlock()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return memoryFile{}, ctx.Err()
+		case <-timer.C:
+		}
+	} else if err := ctx.Err(); err != nil {
+		return memoryFile{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.failure(""); err != nil {
+		return memoryFile{}, err
+	}
+	keys := []string{req.LocalPath, req.URL}
+	if req.Bucket != "" && req.Key != "" {
+		keys = append([]string{req.Bucket + "/" + req.Key}, keys...)
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := m.failure(key); err != nil {
+			return memoryFile{}, err
+		}
+		if file, ok := m.files[key]; ok {
+			return file, nil
+		}
+	}
+	return memoryFile{}, errors.Wrapf(ErrNotFound, "no file in memory backend %q", m.name)
+}
+
+// failure returns the error injected for key, counting it against the injection. m.mu must be held.
+func (m *MemoryBackend) failure(key string) error {
+	f, ok := m.failures[key]
+	if !ok {
+		return nil
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		if f.remaining == 0 {
+			delete(m.failures, key)
+		}
+	}
+	return f.err
+}
@@ -0,0 +1,141 @@
+package getter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryBackend verifies that stored files are served whole or in part with their info, and that
+// deleted files are not found
+func TestMemoryBackend(t *testing.T) {
+	mem := NewMemoryBackend("memory")
+	data := []byte("Subject: hello\r\n\r\nbody")
+	mem.Put("bucket/mail.eml", data, ObjectInfo{ContentType: "message/rfc822", Metadata: map[string]string{"Mail-Id": "42"}})
+
+	for _, test := range []struct {
+		name         string
+		req          FetchRequest
+		expectedData []byte
+		expectedErr  bool
+		expectedKind error
+	}{
+		{name: "remote key", req: FetchRequest{Host: "host", Bucket: "bucket", Key: "mail.eml"}, expectedData: data},
+		{name: "range", req: FetchRequest{Bucket: "bucket", Key: "mail.eml", Range: &ByteRange{Offset: -4}}, expectedData: data[len(data)-4:]},
+		{name: "missing", req: FetchRequest{Bucket: "bucket", Key: "missing.eml"}, expectedErr: true, expectedKind: ErrNotFound},
+		{name: "bad range", req: FetchRequest{Bucket: "bucket", Key: "mail.eml", Range: &ByteRange{Offset: 100}}, expectedErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fh, info, err := mem.Fetch(context.Background(), test.req)
+			if test.expectedErr {
+				require.Error(t, err)
+				if test.expectedKind != nil {
+					assert.Equal(t, test.expectedKind, classify(err))
+				}
+				return
+			}
+			require.NoError(t, err)
+			defer fh.Close()
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, body)
+			assert.Equal(t, int64(len(test.expectedData)), info.Size)
+			assert.Equal(t, "message/rfc822", info.ContentType)
+			assert.Equal(t, "42", info.Metadata["Mail-Id"])
+			assert.Len(t, info.ETag, 32)
+		})
+	}
+
+	info, err := mem.Stat(context.Background(), FetchRequest{Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	info.Metadata["Mail-Id"] = "changed"
+	info, err = mem.Stat(context.Background(), FetchRequest{Bucket: "bucket", Key: "mail.eml"})
+	require.NoError(t, err)
+	assert.Equal(t, "42", info.Metadata["Mail-Id"], "callers get their own copy of the info")
+
+	mem.Delete("bucket/mail.eml")
+	_, err = mem.Stat(context.Background(), FetchRequest{Bucket: "bucket", Key: "mail.eml"})
+	assert.Equal(t, ErrNotFound, classify(err))
+	assert.Equal(t, 4, mem.Fetches(), "stats are not fetches")
+}
+
+// TestMemoryBackendGetter verifies that memory backends stand in for the built in ones, so a Getter's retries
+// and fallbacks can be tested without any real file systems
+func TestMemoryBackendGetter(t *testing.T) {
+	errFlaky := errors.New("flaky")
+	req := FetchRequest{LocalPath: "/var/mail/x.eml", Host: "host", Bucket: "bucket", Key: "x.eml"}
+
+	for _, test := range []struct {
+		name           string
+		setup          func(remote, local *MemoryBackend)
+		expectedData   string
+		expectedSource Source
+		expectedErr    error
+		expectedCalls  int
+	}{
+		{name: "remote", expectedData: "remote data", expectedSource: Remote, expectedCalls: 1},
+		{name: "retried", setup: func(remote, local *MemoryBackend) {
+			remote.InjectError("bucket/x.eml", errUnavailable, 1)
+		}, expectedData: "remote data", expectedSource: Remote, expectedCalls: 2},
+		{name: "falls back", setup: func(remote, local *MemoryBackend) {
+			remote.Delete("bucket/x.eml")
+		}, expectedData: "local data", expectedSource: Local, expectedCalls: 1},
+		{name: "every key fails", setup: func(remote, local *MemoryBackend) {
+			remote.InjectError("", errFlaky, 0)
+			local.InjectError("", ErrAccessDenied, 0)
+		}, expectedSource: Local, expectedErr: ErrAccessDenied, expectedCalls: 1},
+		{name: "error removed", setup: func(remote, local *MemoryBackend) {
+			remote.InjectError("", errFlaky, 0)
+			remote.InjectError("", nil, 0)
+		}, expectedData: "remote data", expectedSource: Remote, expectedCalls: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			remote, local := NewMemoryBackend("memory-remote"), NewMemoryBackend("memory-local")
+			remote.Put("bucket/x.eml", []byte("remote data"), ObjectInfo{})
+			local.Put("/var/mail/x.eml", []byte("local data"), ObjectInfo{})
+			if test.setup != nil {
+				test.setup(remote, local)
+			}
+
+			var fetcher FileFetcher = New(discardLogger(), true, "key", "secret", WithRemoteBackend(remote), WithLocalBackend(local),
+				WithRetryPolicy(RetryPolicy{MaxAttempts: 2}), WithClock(newFakeClock()))
+			fh, source, err := fetcher.Fetch(context.Background(), req)
+			assert.Equal(t, test.expectedSource, source)
+			assert.Equal(t, test.expectedCalls, remote.Fetches())
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr), "%v", err)
+				return
+			}
+			require.NoError(t, err)
+			defer fh.Close()
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, string(body))
+		})
+	}
+}
+
+// TestMemoryBackendLatency verifies that simulated latency delays answers and gives way to the context
+func TestMemoryBackendLatency(t *testing.T) {
+	mem := NewMemoryBackend("memory")
+	mem.Put("/var/mail/x.eml", []byte("data"), ObjectInfo{})
+	mem.SetLatency(20 * time.Millisecond)
+
+	start := time.Now()
+	fh, _, err := mem.Fetch(context.Background(), FetchRequest{LocalPath: "/var/mail/x.eml"})
+	require.NoError(t, err)
+	fh.Close()
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	mem.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = mem.Stat(ctx, FetchRequest{LocalPath: "/var/mail/x.eml"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,92 @@
+package getter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+)
+
+// DefaultClientIdleTimeout is how long a remote client may go unused before the pool evicts it
+const DefaultClientIdleTimeout = 5 * time.Minute
+
+// clientKey identifies a remote client. Clients are only shared between fetches for the same host
+// made with the same credentials.
+type clientKey struct {
+	host  string
+	creds *credentials.Credentials
+}
+
+// pooledClient is a remote client along with when it was last handed out
+type pooledClient struct {
+	client   *minio.Client
+	lastUsed time.Time
+}
+
+// clientPool hands out minio clients, creating them on first use and reusing them afterwards so that
+// keep-alive connections and the bucket location cache survive between fetches. It is safe for
+// concurrent use.
+type clientPool struct {
+	mu          sync.Mutex
+	clients     map[clientKey]*pooledClient
+	idleTimeout time.Duration
+
+	now       func() time.Time
+	newClient func(host string, creds *credentials.Credentials) (*minio.Client, error)
+}
+
+// newClientPool creates a pool that evicts clients unused for longer than idleTimeout.
+// An idleTimeout of zero or less keeps clients forever.
+func newClientPool(idleTimeout time.Duration) *clientPool {
+	return &clientPool{
+		clients:     map[clientKey]*pooledClient{},
+		idleTimeout: idleTimeout,
+		now:         time.Now,
+		newClient: func(host string, creds *credentials.Credentials) (*minio.Client, error) {
+			// the signature version comes from creds, static credentials made by New ask for V2
+			return minio.NewWithCredentials(host, creds, false, "")
+		},
+	}
+}
+
+// get returns the client for host and credentials, creating it if the pool does not have one yet
+func (p *clientPool) get(host string, creds *credentials.Credentials) (*minio.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.evictIdle(now)
+
+	key := clientKey{host: host, creds: creds}
+	if pc, ok := p.clients[key]; ok {
+		pc.lastUsed = now
+		return pc.client, nil
+	}
+
+	client, err := p.newClient(host, creds)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = &pooledClient{client: client, lastUsed: now}
+	return client, nil
+}
+
+// len reports how many clients the pool currently holds
+func (p *clientPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// evictIdle drops clients that have not been used within the idle timeout. p.mu must be held.
+func (p *clientPool) evictIdle(now time.Time) {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	for key, pc := range p.clients {
+		if now.Sub(pc.lastUsed) > p.idleTimeout {
+			delete(p.clients, key)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientPoolReuse verifies that clients are shared per host and credentials only
+func TestClientPoolReuse(t *testing.T) {
+	pool := newClientPool(DefaultClientIdleTimeout)
+	creds := credentials.NewStaticV2("key", "secret", "")
+
+	first, err := pool.get("host:9000", creds)
+	require.NoError(t, err)
+	second, err := pool.get("host:9000", creds)
+	require.NoError(t, err)
+	assert.True(t, first == second, "same host and credentials should share a client")
+
+	otherHost, err := pool.get("other:9000", creds)
+	require.NoError(t, err)
+	assert.False(t, first == otherHost, "different hosts should not share a client")
+
+	otherCreds, err := pool.get("host:9000", credentials.NewStaticV2("key", "other secret", ""))
+	require.NoError(t, err)
+	assert.False(t, first == otherCreds, "different credentials should not share a client")
+
+	assert.Equal(t, 3, pool.len())
+}
+
+// TestClientPoolEvictsIdle verifies that clients unused for longer than the idle timeout are dropped
+func TestClientPoolEvictsIdle(t *testing.T) {
+	now := time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)
+	pool := newClientPool(time.Minute)
+	creds := credentials.NewStaticV2("key", "secret", "")
+	pool.now = func() time.Time { return now }
+
+	idle, err := pool.get("idle:9000", creds)
+	require.NoError(t, err)
+	_, err = pool.get("busy:9000", creds)
+	require.NoError(t, err)
+
+	now = now.Add(45 * time.Second)
+	_, err = pool.get("busy:9000", creds)
+	require.NoError(t, err)
+	assert.Equal(t, 2, pool.len())
+
+	now = now.Add(30 * time.Second)
+	_, err = pool.get("busy:9000", creds)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pool.len(), "idle host should have been evicted")
+
+	again, err := pool.get("idle:9000", creds)
+	require.NoError(t, err)
+	assert.False(t, idle == again, "evicted host should get a fresh client")
+}
+
+// TestClientPoolConcurrent verifies that concurrent callers end up with a single client per key
+func TestClientPoolConcurrent(t *testing.T) {
+	pool := newClientPool(DefaultClientIdleTimeout)
+	var created int64
+	creds := credentials.NewStaticV2("key", "secret", "")
+	pool.newClient = func(host string, creds *credentials.Credentials) (*minio.Client, error) {
+		atomic.AddInt64(&created, 1)
+		return minio.NewWithCredentials(host, creds, false, "")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.get("host:9000", creds)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&created))
+}
+
+// TestMinioWrapperReusesClient verifies that the bucket location is only looked up once across fetches
+func TestMinioWrapperReusesClient(t *testing.T) {
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "key", []byte("file data"))
+
+	m := &minioWrapper{clients: newClientPool(DefaultClientIdleTimeout), creds: credentials.NewStaticV2("key", "secret", "")}
+	for i := 0; i < 3; i++ {
+		fh, _, err := m.Fetch(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "key"})
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(fh)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("file data"), data)
+		fh.Close()
+	}
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&s3.locationRequests))
+}
+
+// BenchmarkMinioWrapperFetch compares reusing pooled clients against building a client for every fetch
+func BenchmarkMinioWrapperFetch(b *testing.B) {
+	s3 := newFakeS3(b)
+	defer s3.Close()
+	s3.Put("bucket", "key", make([]byte, 16*1024))
+
+	for _, bench := range []struct {
+		name        string
+		idleTimeout time.Duration
+	}{
+		{name: "pooled", idleTimeout: DefaultClientIdleTimeout},
+		// a one nanosecond idle timeout evicts the client before every get,
+		// which is what creating a new client per fetch used to do
+		{name: "per-fetch", idleTimeout: time.Nanosecond},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			pool := newClientPool(bench.idleTimeout)
+			m := &minioWrapper{clients: pool, creds: credentials.NewStaticV2("key", "secret", "")}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fh, _, err := m.Fetch(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "key"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, fh)
+				fh.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// ByteRange selects part of a file.
+// A non-negative Offset reads from Offset onwards, stopping after Length bytes when Length is positive.
+// A negative Offset is a suffix range reading the last -Offset bytes, and Length must then be zero.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// ReadSeekCloser is a file that can be read sequentially, seeked, or read at arbitrary offsets
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.ReaderAt
+	io.Closer
+}
+
+// FetchRange is Fetch limited to length bytes starting at offset. See ByteRange for how negative offsets
+// and a zero length are handled.
+func (g *Getter) FetchRange(ctx context.Context, req FetchRequest, offset, length int64) (io.ReadCloser, Source, error) {
+	req.Range = &ByteRange{Offset: offset, Length: length}
+	return g.Fetch(ctx, req)
+}
+
+// FetchSeekable is Fetch returning a file that can be seeked and read at arbitrary offsets.
+// Remote files turn each seek or ReadAt into a range request. req.Range and req.Checksum must not be set,
+// and the content is not checked against ETags. Envelopes are not decrypted, with WithEnvelopeDecryption they
+// fail with ErrDecryption rather than handing over ciphertext.
+func (g *Getter) FetchSeekable(ctx context.Context, req FetchRequest) (ReadSeekCloser, Source, error) {
+	if req.Range != nil {
+		return nil, "", invalidRequestError(req, errors.New("seekable fetches read the whole file, seek instead of setting a range"))
+	}
+	if req.Checksum != nil {
+		return nil, "", invalidRequestError(req, errors.New("seekable fetches cannot be checked against a checksum"))
+	}
+
+	res, err := g.fetch(ctx, req)
+	if err != nil {
+		return nil, res.Source, err
+	}
+
+	rs, ok := res.Body.(ReadSeekCloser)
+	if !ok || !seekable(res.Body) {
+		res.Body.Close()
+		return nil, res.Source, newFetchError(res.Source, req, errors.Errorf("%s source does not support seeking", res.Source))
+	}
+	if g.unwrapper != nil && isEnvelope(res, rs) {
+		rs.Close()
+		return nil, res.Source, newFetchError(res.Source, req, errors.Wrap(ErrDecryption, "envelopes cannot be seeked, fetch them instead"))
+	}
+	return newContextReadSeeker(ctx, rs), res.Source, nil
+}
+
+// bodyWrapper is a body passing Seek and ReadAt on to the body it wraps, failing when that body does not
+// support them
+type bodyWrapper interface {
+	unwrap() io.ReadCloser
+}
+
+// seekable reports whether body, seen through any wrappers, can be seeked and read at offsets
+func seekable(body io.ReadCloser) bool {
+	for {
+		w, ok := body.(bodyWrapper)
+		if !ok {
+			_, ok = body.(ReadSeekCloser)
+			return ok
+		}
+		body = w.unwrap()
+	}
+}
+
+// validate reports whether the range can be asked for
+func (r ByteRange) validate() error {
+	if r.Length < 0 {
+		return errors.Errorf("range length %d cannot be negative", r.Length)
+	}
+	if r.Offset < 0 && r.Length != 0 {
+		return errors.Errorf("suffix range of %d bytes cannot have a length", -r.Offset)
+	}
+	return nil
+}
+
+// bounds returns where the range starts and how many bytes it covers within a file of size bytes
+func (r ByteRange) bounds(size int64) (start, length int64, err error) {
+	if r.Offset < 0 {
+		length = -r.Offset
+		if length > size {
+			length = size
+		}
+		return size - length, length, nil
+	}
+
+	if r.Offset > 0 && r.Offset >= size {
+		return 0, 0, errors.Errorf("range offset %d is beyond the end of the file (%d bytes)", r.Offset, size)
+	}
+	length = size - r.Offset
+	if r.Length > 0 && r.Length < length {
+		length = r.Length
+	}
+	return r.Offset, length, nil
+}
+
+// setRange adds the range header for r to opts
+func (r ByteRange) setRange(opts *minio.GetObjectOptions) error {
+	switch {
+	case r.Offset < 0:
+		// bytes=-N
+		return opts.SetRange(0, r.Offset)
+	case r.Length > 0:
+		// bytes=N-M
+		return opts.SetRange(r.Offset, r.Offset+r.Length-1)
+	case r.Offset > 0:
+		// bytes=N-
+		return opts.SetRange(r.Offset, 0)
+	}
+	// the whole file
+	return nil
+}
+
+// rangeReadSize is how much of a remote range is read up front
+const rangeReadSize = 32 * 1024
+
+// fetchRemoteRange starts a ranged read of obj. Stat would drop the range header, so the first read is made
+// up front instead, surfacing errors before the caller gets the file and describing the range rather than
+// the whole object.
+func fetchRemoteRange(obj *minio.Object) (io.ReadCloser, minio.ObjectInfo, error) {
+	buf := make([]byte, rangeReadSize)
+	n, err := obj.Read(buf)
+	if err != nil && err != io.EOF {
+		obj.Close()
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	// minio only keeps the info of a first read that did not reach the end of the range, so a short
+	// range is described by a separate stat of the object
+	info, statErr := obj.Stat()
+	if statErr != nil {
+		obj.Close()
+		return nil, minio.ObjectInfo{}, statErr
+	}
+
+	if err == io.EOF {
+		// the whole range has been read
+		obj.Close()
+		info.Size = int64(n)
+		return ioutil.NopCloser(bytes.NewReader(buf[:n])), info, nil
+	}
+	return &readCloser{Reader: io.MultiReader(bytes.NewReader(buf[:n]), obj), Closer: obj}, info, nil
+}
+
+// sectionFile is the part of a local file covered by a range
+type sectionFile struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// readCloser pairs a Reader with the Closer of what it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,165 @@
+package getter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeData is the file the range tests slice up
+var rangeData = []byte("Subject: hello\r\n\r\nbody of the mail")
+
+// rangeFixture serves rangeData both remotely and from a local file
+type rangeFixture struct {
+	s3        *fakeS3
+	dir       string
+	localPath string
+}
+
+func newRangeFixture(t *testing.T) *rangeFixture {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	localPath := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(localPath, rangeData, 0600))
+
+	s3 := newFakeS3(t)
+	s3.Put("bucket", "mail.eml", rangeData)
+	return &rangeFixture{s3: s3, dir: dir, localPath: localPath}
+}
+
+func (f *rangeFixture) Close() {
+	f.s3.Close()
+	os.RemoveAll(f.dir)
+}
+
+// request returns a request for the fixture file, remote capable or not
+func (f *rangeFixture) request(remote bool) FetchRequest {
+	req := FetchRequest{LocalPath: f.localPath}
+	if remote {
+		req.Host, req.Bucket, req.Key = f.s3.Host(), "bucket", "mail.eml"
+	}
+	return req
+}
+
+// TestFetchRange verifies that ranges are honoured by both sources, and that remote ranges are real range requests
+func TestFetchRange(t *testing.T) {
+	f := newRangeFixture(t)
+	defer f.Close()
+
+	for _, test := range []struct {
+		name           string
+		offset         int64
+		length         int64
+		expectedData   string
+		expectedHeader string
+	}{
+		{name: "whole file", offset: 0, length: 0, expectedData: string(rangeData), expectedHeader: ""},
+		{name: "prefix", offset: 0, length: 14, expectedData: "Subject: hello", expectedHeader: "bytes=0-13"},
+		{name: "middle", offset: 9, length: 5, expectedData: "hello", expectedHeader: "bytes=9-13"},
+		{name: "from offset to end", offset: 18, length: 0, expectedData: "body of the mail", expectedHeader: "bytes=18-"},
+		{name: "length past the end", offset: 30, length: 100, expectedData: "mail", expectedHeader: "bytes=30-129"},
+		{name: "suffix", offset: -4, length: 0, expectedData: "mail", expectedHeader: "bytes=-4"},
+		{name: "suffix longer than file", offset: -1000, length: 0, expectedData: string(rangeData), expectedHeader: "bytes=-1000"},
+	} {
+		for _, remote := range []bool{true, false} {
+			expectedSource := Local
+			if remote {
+				expectedSource = Remote
+			}
+			t.Run(test.name+"/"+string(expectedSource), func(t *testing.T) {
+				f.s3.mu.Lock()
+				f.s3.ranges = nil
+				f.s3.mu.Unlock()
+
+				fetcher := New(discardLogger(), remote, "key", "secret")
+				fh, source, err := fetcher.FetchRange(context.Background(), f.request(remote), test.offset, test.length)
+				require.NoError(t, err)
+				defer fh.Close()
+				assert.Equal(t, expectedSource, source)
+
+				data, err := ioutil.ReadAll(fh)
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedData, string(data))
+
+				if remote {
+					f.s3.mu.Lock()
+					defer f.s3.mu.Unlock()
+					assert.Contains(t, f.s3.ranges, test.expectedHeader)
+				}
+			})
+		}
+	}
+}
+
+// TestFetchRangeInvalid verifies that bad ranges are rejected up front and unsatisfiable ones fail
+func TestFetchRangeInvalid(t *testing.T) {
+	f := newRangeFixture(t)
+	defer f.Close()
+	fetcher := New(discardLogger(), false, "key", "secret")
+
+	_, _, err := fetcher.FetchRange(context.Background(), f.request(false), -4, 2)
+	assert.Error(t, err, "suffix ranges cannot have a length")
+	_, _, err = fetcher.FetchRange(context.Background(), f.request(false), 0, -1)
+	assert.Error(t, err, "lengths cannot be negative")
+	_, _, err = fetcher.FetchRange(context.Background(), f.request(false), int64(len(rangeData)), 0)
+	assert.Error(t, err, "offsets past the end cannot be satisfied")
+}
+
+// TestFetchSeekable verifies that both sources can be seeked and read at offsets
+func TestFetchSeekable(t *testing.T) {
+	f := newRangeFixture(t)
+	defer f.Close()
+
+	for _, remote := range []bool{true, false} {
+		fetcher := New(discardLogger(), remote, "key", "secret")
+		ctx, cancel := context.WithCancel(context.Background())
+		fh, _, err := fetcher.FetchSeekable(ctx, f.request(remote))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = fh.ReadAt(buf, 9)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		pos, err := fh.Seek(-4, io.SeekEnd)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(rangeData)-4), pos)
+		data, err := ioutil.ReadAll(fh)
+		require.NoError(t, err)
+		assert.Equal(t, "mail", string(data))
+
+		cancel()
+		_, err = fh.ReadAt(buf, 0)
+		assert.Equal(t, context.Canceled, err)
+		fh.Close()
+	}
+
+	fetcher := New(discardLogger(), false, "key", "secret")
+	req := f.request(false)
+	req.Range = &ByteRange{Offset: 1}
+	_, _, err := fetcher.FetchSeekable(context.Background(), req)
+	assert.Error(t, err, "seekable fetches cannot take a range")
+
+	fetcher.local = &fakeLocal{data: rangeData}
+	_, _, err = fetcher.FetchSeekable(context.Background(), f.request(false))
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr), "sources that cannot seek are reported: %v", err)
+	assert.Equal(t, Local, fetchErr.Source)
+
+	// hedging wraps the body it returns, the wrapped body is what must be seekable
+	hedged := New(discardLogger(), true, "key", "secret", WithHedging(time.Millisecond))
+	hedged.remote = &fakeRemote{data: rangeData}
+	hedged.local = &fakeLocal{err: os.ErrNotExist}
+	_, _, err = hedged.FetchSeekable(context.Background(), FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"})
+	require.True(t, errors.As(err, &fetchErr), "wrapped sources that cannot seek are reported: %v", err)
+	assert.Equal(t, Remote, fetchErr.Source)
+	assert.Contains(t, err.Error(), "does not support seeking")
+}
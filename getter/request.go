@@ -0,0 +1,103 @@
+package getter
+
+import (
+	"strings"
+
+	"github.com/minio/minio-go/pkg/s3utils"
+	"github.com/pkg/errors"
+)
+
+// FetchRequest names a file that can be read from the remote file system, the local file system, or both.
+// Using named fields instead of positional strings keeps callers from mixing up the location parts.
+type FetchRequest struct {
+	// LocalPath is where the file lives on the local file system. Like Key, it may name a member of a tar or
+	// zip archive as in bundle.tar.gz#path/in/archive.
+	LocalPath string
+	// Host is the host[:port] of the remote file system
+	Host string
+	// Bucket is the remote bucket holding the file
+	Bucket string
+	// Key is the name of the file within Bucket
+	Key string
+	// URL is an http or https URL the file can be downloaded from, see HTTPSettings. The fragment of a URL
+	// of an archive names a member of it.
+	URL string
+	// Range limits the fetch to part of the file, the whole file is read when nil
+	Range *ByteRange
+	// Sources are the backends tried for the request, in order, instead of the order the Getter would pick.
+	// They must be among the backends the Getter's Strategy or WithBackends allow, an invalid request otherwise.
+	// ParseURI sets them to follow the order of a primary and fallback URI.
+	Sources []Source
+	// Checksum is checked against the content as it is read, reporting a ChecksumError at the end
+	// of a file that does not match. It cannot be combined with Range.
+	Checksum *Checksum
+}
+
+// Validate reports whether the request can be served. A request needs a local path, a complete and well formed
+// remote location or a well formed URL. An incomplete or malformed remote location or URL is not an error on its
+// own since the local path can still be used, the remote file system is skipped instead.
+// Errors are a *FetchError matching ErrInvalidRequest.
+func (r FetchRequest) Validate() error {
+	if err := r.validate(); err != nil {
+		return invalidRequestError(r, err)
+	}
+	return nil
+}
+
+// validate does the work of Validate, returning the bare reason the request is invalid
+func (r FetchRequest) validate() error {
+	remoteErr := r.remoteErr()
+	var urlErr error
+	if r.URL != "" {
+		urlErr = validateURL(r.URL)
+	}
+	if r.LocalPath == "" && (!r.hasRemote() || remoteErr != nil) && (r.URL == "" || urlErr != nil) {
+		switch {
+		case remoteErr != nil:
+			return remoteErr
+		case urlErr != nil:
+			return urlErr
+		}
+		return errors.Errorf(`no local path and incomplete remote location. "host":%q, "bucket":%q, "key":%q`, r.Host, r.Bucket, r.Key)
+	}
+	if r.Range != nil {
+		if err := r.Range.validate(); err != nil {
+			return errors.Wrap(err, "invalid range")
+		}
+	}
+	if r.Range != nil && r.namesArchiveMember() {
+		return errors.New("a range cannot be read from an archive member")
+	}
+	if r.Checksum != nil {
+		if r.Range != nil {
+			return errors.New("a checksum covers the whole file and cannot be checked against a range")
+		}
+		if err := r.Checksum.validate(); err != nil {
+			return errors.Wrap(err, "invalid checksum")
+		}
+	}
+	return nil
+}
+
+// remoteErr reports what is malformed about the remote parts the request has, nil when they are all well formed
+func (r FetchRequest) remoteErr() error {
+	if r.Host != "" && strings.ContainsAny(r.Host, `/\`) {
+		return errors.Errorf("host %q must be of the form host[:port]", r.Host)
+	}
+	if r.Bucket != "" {
+		if err := s3utils.CheckValidBucketName(r.Bucket); err != nil {
+			return errors.Wrapf(err, "invalid bucket %q", r.Bucket)
+		}
+	}
+	if r.Key != "" {
+		if err := s3utils.CheckValidObjectName(r.Key); err != nil {
+			return errors.Wrapf(err, "invalid key %q", r.Key)
+		}
+	}
+	return nil
+}
+
+// hasRemote reports whether the request has everything needed to reach the remote file system
+func (r FetchRequest) hasRemote() bool {
+	return r.Host != "" && r.Bucket != "" && r.Key != ""
+}
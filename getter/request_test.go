@@ -0,0 +1,91 @@
+package getter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFetchRequestValidate verifies which requests can be served
+func TestFetchRequestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		req  FetchRequest
+		// a substring of the expected error, empty when the request is valid
+		expectedErr string
+	}{
+		{
+			name: "complete request",
+			req:  FetchRequest{LocalPath: "/var/mail/x.eml", Host: "s3.example.com:9000", Bucket: "mail", Key: "x.eml"},
+		},
+		{
+			name: "local only",
+			req:  FetchRequest{LocalPath: "/var/mail/x.eml"},
+		},
+		{
+			name: "remote only",
+			req:  FetchRequest{Host: "s3.example.com", Bucket: "mail", Key: "x.eml"},
+		},
+		{
+			name: "incomplete remote with local path",
+			req:  FetchRequest{LocalPath: "/var/mail/x.eml", Bucket: "mail"},
+		},
+		{
+			name:        "nothing to fetch",
+			req:         FetchRequest{Host: "s3.example.com", Key: "x.eml"},
+			expectedErr: "no local path and incomplete remote location",
+		},
+		{
+			name:        "local path passed as host",
+			req:         FetchRequest{Host: "/var/mail/x.eml", Bucket: "mail", Key: "x.eml"},
+			expectedErr: `host "/var/mail/x.eml" must be of the form host[:port]`,
+		},
+		{
+			name:        "key passed as bucket",
+			req:         FetchRequest{Host: "s3.example.com", Bucket: "2018/03/x.eml", Key: "mail"},
+			expectedErr: `invalid bucket "2018/03/x.eml"`,
+		},
+		{
+			name: "malformed remote with local path",
+			req:  FetchRequest{LocalPath: "/var/mail/x.eml", Host: "s3.example.com", Bucket: "2018/03/x.eml", Key: "mail"},
+		},
+		{
+			name: "malformed url with local path",
+			req:  FetchRequest{LocalPath: "/var/mail/x.eml", URL: "ftp://example.com/x.eml"},
+		},
+		{
+			name:        "malformed url",
+			req:         FetchRequest{URL: "ftp://example.com/x.eml"},
+			expectedErr: "must be http or https",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.req.Validate()
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.expectedErr)
+			}
+		})
+	}
+}
+
+// TestFetchInvalidRequest verifies that an invalid request never reaches either file system
+func TestFetchInvalidRequest(t *testing.T) {
+	fetcher := New(discardLogger(), true, "accesskey", "accesssecret")
+	remote := &fakeRemote{data: []byte("file data")}
+	local := &fakeLocal{data: []byte("file data")}
+	fetcher.remote = remote
+	fetcher.local = local
+
+	fh, source, err := fetcher.Fetch(context.Background(), FetchRequest{Host: "host", Bucket: "bucket"})
+
+	assert.Nil(t, fh)
+	assert.Equal(t, Source(""), source)
+	assert.Error(t, err)
+	assert.False(t, remote.fetched)
+	assert.False(t, local.opened)
+}
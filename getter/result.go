@@ -0,0 +1,124 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// userMetadataPrefix marks the headers holding user defined metadata on remote objects
+const userMetadataPrefix = "X-Amz-Meta-"
+
+// ObjectInfo describes a fetched file
+type ObjectInfo struct {
+	// Size is the number of bytes that will be read from the file, -1 when unknown
+	Size int64
+	// ETag is the remote entity tag, usually the hex MD5 of the content. Local files have none.
+	ETag string
+	// LastModified is when the file was last written
+	LastModified time.Time
+	// ContentType is the MIME type the remote file was stored with. Local files have none.
+	ContentType string
+	// ContentEncoding is the Content-Encoding the remote file was stored with, such as gzip. Local files have none.
+	ContentEncoding string
+	// ServerSideEncryption is how the remote file system encrypts the file, SSE-C, KMS or S3 as named by
+	// minio-go/pkg/encrypt, empty when it does not
+	ServerSideEncryption string
+	// Metadata holds the user defined metadata of a remote file, keyed without the x-amz-meta- prefix
+	Metadata map[string]string
+}
+
+// FetchResult is a fetched file along with where it came from and what is known about it
+type FetchResult struct {
+	// Body is the content of the file, the caller must Close it
+	Body io.ReadCloser
+	// Source says which file system served the file
+	Source Source
+	// Host is the remote host that served the file, empty for local files
+	Host string
+	// OriginalEncoding is how the file is stored and DecodedEncoding how Body is encoded. They differ when
+	// WithDecompression has decompressed the file, and are empty without it.
+	OriginalEncoding Encoding
+	DecodedEncoding  Encoding
+	// Decrypted is set when WithEnvelopeDecryption has opened the file's envelope
+	Decrypted bool
+	ObjectInfo
+}
+
+// FetchObject is Fetch returning the file's metadata along with its content.
+// The metadata comes from the same request as the content, so no extra Stat is needed.
+func (g *Getter) FetchObject(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	res, err := g.fetchObject(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fetchObject does the work of FetchObject, putting the body through the checks and transformations
+// the request and Getter ask for. Like fetch, the result is never nil.
+func (g *Getter) fetchObject(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	res, err := g.fetchShared(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	g.verify(req, res)
+	if err := g.decrypt(ctx, req, res); err != nil {
+		return &FetchResult{Source: res.Source}, newFetchError(res.Source, req, err)
+	}
+	if err := g.decode(req, res); err != nil {
+		return &FetchResult{Source: res.Source}, newFetchError(res.Source, req, err)
+	}
+	res.Body = newContextReader(ctx, res.Body)
+	return res, nil
+}
+
+// objectInfoFromMinio converts what the remote file system told us about an object
+func objectInfoFromMinio(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Size:                 info.Size,
+		ETag:                 info.ETag,
+		LastModified:         info.LastModified,
+		ContentType:          info.ContentType,
+		ContentEncoding:      info.Metadata.Get("Content-Encoding"),
+		ServerSideEncryption: serverSideEncryptionOf(info.Metadata),
+		Metadata:             userMetadata(info.Metadata),
+	}
+}
+
+// objectInfoFromFile converts what the local file system told us about a file.
+// size is passed separately since a range may cover less than the whole file.
+func objectInfoFromFile(info os.FileInfo, size int64) ObjectInfo {
+	return ObjectInfo{
+		Size:         size,
+		LastModified: info.ModTime(),
+	}
+}
+
+// userMetadata picks the user defined metadata out of object headers
+func userMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range header {
+		if len(v) > 0 && strings.HasPrefix(http.CanonicalHeaderKey(k), userMetadataPrefix) {
+			metadata[http.CanonicalHeaderKey(k)[len(userMetadataPrefix):]] = v[0]
+		}
+	}
+	return metadata
+}
+
+// copyMetadata returns a copy of metadata, nil when it is nil
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
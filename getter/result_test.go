@@ -0,0 +1,97 @@
+package getter
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchObjectRemote verifies that remote results carry the object's metadata
+func TestFetchObjectRemote(t *testing.T) {
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	data := []byte("Subject: hello\r\n\r\nbody")
+	s3.PutWithHeader("bucket", "mail.eml", data, http.Header{
+		"Content-Type":       []string{"message/rfc822; charset=utf-8"},
+		"X-Amz-Meta-Mail-Id": []string{"42"},
+	})
+	sum := md5.Sum(data)
+
+	fetcher := New(discardLogger(), true, "key", "secret")
+	req := FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "mail.eml"}
+	res, err := fetcher.FetchObject(context.Background(), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, Remote, res.Source)
+	assert.Equal(t, int64(len(data)), res.Size)
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.ETag)
+	assert.True(t, fakeS3ModTime.Equal(res.LastModified))
+	assert.Equal(t, "message/rfc822; charset=utf-8", res.ContentType)
+	assert.Equal(t, map[string]string{"Mail-Id": "42"}, res.Metadata)
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+
+	req.Range = &ByteRange{Offset: 0, Length: 7}
+	res, err = fetcher.FetchObject(context.Background(), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, int64(7), res.Size, "ranged results describe the range")
+	assert.Equal(t, hex.EncodeToString(sum[:]), res.ETag)
+
+	// ranges longer than the up front read are streamed the rest of the way
+	big := make([]byte, 3*rangeReadSize)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	s3.Put("bucket", "big.eml", big)
+	res, err = fetcher.FetchObject(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: "big.eml", Range: &ByteRange{Offset: 10, Length: 2 * rangeReadSize}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, int64(2*rangeReadSize), res.Size)
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, big[10:10+2*rangeReadSize], body)
+}
+
+// TestFetchObjectLocal verifies that local results carry what the file system knows about the file
+func TestFetchObjectLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mail.eml")
+	data := []byte("Subject: hello\r\n\r\nbody")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	modTime := time.Date(2018, time.February, 3, 4, 5, 6, 0, time.UTC)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	fetcher := New(discardLogger(), false, "key", "secret")
+	res, err := fetcher.FetchObject(context.Background(), FetchRequest{LocalPath: path})
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, Local, res.Source)
+	assert.Equal(t, int64(len(data)), res.Size)
+	assert.True(t, modTime.Equal(res.LastModified))
+	assert.Empty(t, res.ETag)
+
+	res, err = fetcher.FetchObject(context.Background(), FetchRequest{LocalPath: path, Range: &ByteRange{Offset: -4}})
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, int64(4), res.Size)
+
+	_, err = fetcher.FetchObject(context.Background(), FetchRequest{LocalPath: filepath.Join(dir, "missing.eml")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,322 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+// Clock tells the time and waits. It is swapped out in tests so retries do not really sleep.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by package time
+type realClock struct{}
+
+// Now returns the current time
+func (realClock) Now() time.Time { return time.Now() }
+
+// After waits for d to pass and then sends the current time on the returned channel
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RetryPolicy controls how often a failed remote fetch is tried again before falling back to local.
+// The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, doubling for each one after it
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts, zero means no cap
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, of each wait that is randomly taken off
+	// to keep workers from retrying in lockstep
+	Jitter float64
+	// Retryable decides whether an error is worth another attempt, IsRetryable when nil
+	Retryable func(error) bool
+}
+
+// WithRetryPolicy retries failed remote fetches according to p before falling back to local
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(g *Getter) {
+		g.retry = p
+	}
+}
+
+// WithClock replaces the clock used to time retries
+func WithClock(c Clock) Option {
+	return func(g *Getter) {
+		g.clock = c
+	}
+}
+
+// retryableCodes are remote error codes for conditions that usually clear up on their own
+var retryableCodes = map[string]bool{
+	"InternalError":        true,
+	"ServiceUnavailable":   true,
+	"SlowDown":             true,
+	"RequestTimeout":       true,
+	"RequestTimeTooSkewed": true,
+	"ExpiredToken":         true,
+}
+
+// IsRetryable reports whether err looks transient: server side failures, throttling, timeouts,
+// and connections that were reset or cut short. Missing files, denied access and cancellation are not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+
+	if httpErr, ok := cause.(*HTTPError); ok {
+		code := httpErr.StatusCode
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+
+	if resp, ok := cause.(minio.ErrorResponse); ok {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || retryableCodes[resp.Code]
+	}
+
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	switch netCause(cause) {
+	case io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.EPIPE:
+		return true
+	}
+	return false
+}
+
+// netCause strips the url, net and syscall wrappers the standard library puts around a failed connection
+func netCause(err error) error {
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return err
+		}
+	}
+}
+
+// attempts returns how many tries the policy allows
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retryable reports whether err should be retried under the policy
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns how long to wait after the given failed attempt, counting from 1.
+// random is a number in [0, 1) used for jitter.
+func (p RetryPolicy) delay(attempt int, random float64) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * p.Jitter * random)
+	}
+	return d
+}
+
+// fetchRemote fetches req remotely, retrying failures the retry policy allows for as long as the
+// host's circuit breaker lets us
+func (g *Getter) fetchRemote(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	var fh io.ReadCloser
+	var info ObjectInfo
+	err := g.withRetry(ctx, req.Host, "fetch", func() error {
+		var err error
+		fh, info, err = g.remote.Fetch(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return fh, info, nil
+}
+
+// fetchHTTP fetches req.URL, retrying like fetchRemote against the circuit breaker of the URL's host
+func (g *Getter) fetchHTTP(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	var fh io.ReadCloser
+	var info ObjectInfo
+	host := urlHost(req.URL)
+	err := g.withRetry(ctx, host, "url fetch", func() error {
+		var err error
+		fh, info, err = g.http.Fetch(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FetchResult{Body: fh, Source: HTTP, Host: host, ObjectInfo: info}, nil
+}
+
+// statHTTP HEADs req.URL, retrying like fetchHTTP
+func (g *Getter) statHTTP(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := g.withRetry(ctx, urlHost(req.URL), "url stat", func() error {
+		var err error
+		info, err = g.http.Stat(ctx, req)
+		return err
+	})
+	return info, err
+}
+
+// statRemote looks up what the remote file system knows about req without fetching it, retrying like fetchRemote
+func (g *Getter) statRemote(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	var info ObjectInfo
+	err := g.withRetry(ctx, req.Host, "stat", func() error {
+		var err error
+		info, err = g.remote.Stat(ctx, req)
+		return err
+	})
+	return info, err
+}
+
+// withRetry calls attempt until it succeeds, fails for good, or g.retry runs out of attempts.
+// Each attempt is counted against the circuit breaker of host. op names the attempt in logs.
+func (g *Getter) withRetry(ctx context.Context, host, op string, attempt func() error) error {
+	attempts := g.retry.attempts()
+	for n := 1; ; n++ {
+		var admitted admission
+		if g.breakers != nil {
+			var ok bool
+			if admitted, ok = g.breakers.allow(host); !ok {
+				return errors.Wrapf(ErrCircuitOpen, "host %q", host)
+			}
+		}
+		err := attempt()
+		if g.breakers != nil {
+			g.breakers.done(host, admitted, err)
+		}
+		if err == nil {
+			return nil
+		}
+		if n >= attempts || ctx.Err() != nil || !g.retry.retryable(err) {
+			return err
+		}
+
+		d := g.retry.delay(n, g.random())
+		g.logger.Printf("retrying remote %s in %v, attempt %d of %d - %v", op, d, n+1, attempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-g.clock.After(d):
+		}
+	}
+}
+
+// minioRetriedCodes are the error codes minio-go retries on its own, see singleAttemptTransport
+var minioRetriedCodes = map[string]bool{
+	"RequestError":          true,
+	"RequestTimeout":        true,
+	"Throttling":            true,
+	"ThrottlingException":   true,
+	"RequestLimitExceeded":  true,
+	"RequestThrottled":      true,
+	"InternalError":         true,
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"SlowDown":              true,
+}
+
+// singleAttemptTransport keeps minio-go from retrying requests itself, with sleeps no clock or context
+// controls, so that only the RetryPolicy decides whether a request is tried again. Failures minio-go would
+// retry are handed to it as a *singleAttemptError it gives up on at once, singleAttemptCause recovers them.
+type singleAttemptTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip sends req once, turning failures minio-go would retry into a *singleAttemptError
+func (t singleAttemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "EOF") {
+			// minio-go retries connections cut short
+			return nil, &singleAttemptError{err: err}
+		}
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusPartialContent:
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, &singleAttemptError{err: err}
+	}
+	errResp := minio.ErrorResponse{Code: resp.Status, Message: resp.Status}
+	xml.Unmarshal(body, &errResp)
+	errResp.StatusCode, errResp.Headers = resp.StatusCode, resp.Header
+	if errResp.RequestID == "" {
+		errResp.RequestID = resp.Header.Get("x-amz-request-id")
+	}
+	code := resp.StatusCode
+	if code >= 500 || code == http.StatusTooManyRequests || minioRetriedCodes[errResp.Code] {
+		return nil, &singleAttemptError{err: errResp}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// singleAttemptError is a failed request minio-go would have retried
+type singleAttemptError struct {
+	err error
+}
+
+// Error describes the failure. minio-go retries errors mentioning EOF, so the text of err cannot be used as is.
+func (e *singleAttemptError) Error() string {
+	return "remote request failed - " + strings.Replace(e.err.Error(), "EOF", "end of stream", -1)
+}
+
+// singleAttemptCause returns the failure singleAttemptTransport handed to minio-go in place of err,
+// or err when there is none
+func singleAttemptCause(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	e, ok := urlErr.Err.(*singleAttemptError)
+	if !ok {
+		return err
+	}
+	if _, ok := e.err.(minio.ErrorResponse); ok {
+		return e.err
+	}
+	return &url.Error{Op: urlErr.Op, URL: urlErr.URL, Err: e.err}
+}
@@ -0,0 +1,277 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock records every wait and returns from it immediately, moving its time forward
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+	// block makes After never fire, for tests that cancel during a wait
+	block bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, time.March, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	if !c.block {
+		c.now = c.now.Add(d)
+		ch <- c.now
+	}
+	return ch
+}
+
+// Advance moves the clock forward without waiting
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// flakyRemote fails with each of errs in turn, then succeeds
+type flakyRemote struct {
+	mu    sync.Mutex
+	data  []byte
+	errs  []error
+	calls int
+}
+
+func (f *flakyRemote) Name() string {
+	return string(Remote)
+}
+
+func (f *flakyRemote) Fetch(ctx context.Context, req FetchRequest) (io.ReadCloser, ObjectInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, ObjectInfo{}, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), ObjectInfo{Size: int64(len(f.data))}, nil
+}
+
+func (f *flakyRemote) Stat(ctx context.Context, req FetchRequest) (ObjectInfo, error) {
+	return ObjectInfo{Size: int64(len(f.data))}, nil
+}
+
+var (
+	errUnavailable = minio.ErrorResponse{Code: "ServiceUnavailable", StatusCode: 503}
+	errNoSuchKey   = minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}
+)
+
+// TestFetchRetry verifies that transient remote failures are retried with backoff before falling back to local
+func TestFetchRetry(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		policy         RetryPolicy
+		remoteErrs     []error
+		expectedSource Source
+		expectedCalls  int
+		expectedWaits  []time.Duration
+	}{
+		{
+			name:           "default policy does not retry",
+			remoteErrs:     []error{errUnavailable},
+			expectedSource: Local,
+			expectedCalls:  1,
+		},
+		{
+			name:           "transient failure then success",
+			policy:         RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond},
+			remoteErrs:     []error{pkgerrors.Wrap(errUnavailable, "unable to get remote file info")},
+			expectedSource: Remote,
+			expectedCalls:  2,
+			expectedWaits:  []time.Duration{100 * time.Millisecond},
+		},
+		{
+			name:           "attempts exhausted, fall back to local",
+			policy:         RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond},
+			remoteErrs:     []error{errUnavailable, errUnavailable, errUnavailable},
+			expectedSource: Local,
+			expectedCalls:  3,
+			expectedWaits:  []time.Duration{100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:           "delay is capped",
+			policy:         RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 250 * time.Millisecond},
+			remoteErrs:     []error{errUnavailable, errUnavailable, errUnavailable, errUnavailable},
+			expectedSource: Remote,
+			expectedCalls:  5,
+			expectedWaits:  []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond, 250 * time.Millisecond},
+		},
+		{
+			name:           "permanent failure is not retried",
+			policy:         RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond},
+			remoteErrs:     []error{errNoSuchKey},
+			expectedSource: Local,
+			expectedCalls:  1,
+		},
+		{
+			name: "custom classification",
+			policy: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, Retryable: func(err error) bool {
+				return minio.ToErrorResponse(err).Code == "NoSuchKey"
+			}},
+			remoteErrs:     []error{errNoSuchKey},
+			expectedSource: Remote,
+			expectedCalls:  2,
+			expectedWaits:  []time.Duration{time.Second},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			remote := &flakyRemote{data: []byte("file data"), errs: test.remoteErrs}
+			fetcher := New(discardLogger(), true, "key", "secret", WithRetryPolicy(test.policy), WithClock(clock))
+			fetcher.remote = remote
+			fetcher.local = &fakeLocal{data: []byte("file data")}
+
+			fh, source, err := fetcher.FetchFile("localpath", "host", "bucket", "key")
+			require.NoError(t, err)
+			fh.Close()
+
+			assert.Equal(t, test.expectedSource, source)
+			assert.Equal(t, test.expectedCalls, remote.calls)
+			assert.Equal(t, test.expectedWaits, clock.waits)
+		})
+	}
+}
+
+// TestFetchRetryCancelled verifies that cancelling while waiting to retry ends the fetch without falling back
+func TestFetchRetryCancelled(t *testing.T) {
+	clock := newFakeClock()
+	clock.block = true
+	logBuf := &bytes.Buffer{}
+	fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "key", "secret",
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour}), WithClock(clock))
+	fetcher.remote = &flakyRemote{errs: []error{errUnavailable}}
+	local := &fakeLocal{data: []byte("file data")}
+	fetcher.local = local
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, source, err := fetcher.FetchFileContext(ctx, "localpath", "host", "bucket", "key")
+
+	assert.Equal(t, Remote, source)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, local.opened)
+	assert.Contains(t, logBuf.String(), "retrying remote fetch in 1h0m0s, attempt 2 of 3")
+}
+
+// TestRetryDelayJitter verifies that jitter takes a random fraction off the delay
+func TestRetryDelayJitter(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, Jitter: 0.5}
+	assert.Equal(t, 100*time.Millisecond, p.delay(1, 0))
+	assert.Equal(t, 75*time.Millisecond, p.delay(1, 0.5))
+	assert.Equal(t, 150*time.Millisecond, p.delay(2, 0.5))
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestIsRetryable verifies the default classification of remote errors
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "nil", err: nil, expected: false},
+		{name: "service unavailable", err: errUnavailable, expected: true},
+		{name: "internal error", err: minio.ErrorResponse{Code: "InternalError", StatusCode: 500}, expected: true},
+		{name: "throttled", err: minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, expected: true},
+		{name: "throttled head", err: minio.ErrorResponse{Code: "429 Too Many Requests", StatusCode: 429}, expected: true},
+		{name: "wrapped server error", err: pkgerrors.Wrap(errUnavailable, "unable to get remote file info"), expected: true},
+		{name: "not found", err: errNoSuchKey, expected: false},
+		{name: "access denied", err: minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, expected: false},
+		{name: "connection reset", err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, expected: true},
+		{name: "connection refused", err: pkgerrors.Wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "unable to get remote file info"), expected: true},
+		{name: "broken pipe in url error", err: &url.Error{Op: "Get", URL: "https://example.com/x.eml", Err: &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}}, expected: true},
+		{name: "timeout in url error", err: &url.Error{Op: "Get", URL: "https://example.com/x.eml", Err: timeoutError{}}, expected: true},
+		{name: "other syscall error", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EACCES)}, expected: false},
+		{name: "truncated body", err: pkgerrors.Wrap(io.ErrUnexpectedEOF, "unable to get remote file info"), expected: true},
+		{name: "timeout", err: timeoutError{}, expected: true},
+		{name: "http server error", err: &HTTPError{StatusCode: 502, Status: "502 Bad Gateway"}, expected: true},
+		{name: "http throttled", err: &HTTPError{StatusCode: 429, Status: "429 Too Many Requests"}, expected: true},
+		{name: "http not found", err: &HTTPError{StatusCode: 404, Status: "404 Not Found"}, expected: false},
+		{name: "cancelled", err: pkgerrors.Wrap(context.Canceled, "unable to get remote file info"), expected: false},
+		{name: "deadline", err: context.DeadlineExceeded, expected: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsRetryable(test.err))
+		})
+	}
+}
+
+// TestFetchRemoteRetriesOnlyByPolicy verifies that the remote file system client does not retry failures
+// itself, so the RetryPolicy alone decides how many requests are made and how long they are apart
+func TestFetchRemoteRetriesOnlyByPolicy(t *testing.T) {
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.PutError("bucket", "unavailable.eml", http.StatusServiceUnavailable, "ServiceUnavailable")
+	s3.PutError("bucket", "internal.eml", http.StatusInternalServerError, "InternalError")
+	s3.PutError("bucket", "throttled.eml", http.StatusTooManyRequests, "SlowDown")
+
+	for _, test := range []struct {
+		name             string
+		key              string
+		maxAttempts      int
+		expectedRequests int64
+		expectedStatus   int
+	}{
+		{name: "single attempt", key: "unavailable.eml", maxAttempts: 1, expectedRequests: 1, expectedStatus: http.StatusServiceUnavailable},
+		{name: "three attempts", key: "unavailable.eml", maxAttempts: 3, expectedRequests: 3, expectedStatus: http.StatusServiceUnavailable},
+		{name: "internal error", key: "internal.eml", maxAttempts: 1, expectedRequests: 1, expectedStatus: http.StatusInternalServerError},
+		{name: "throttled", key: "throttled.eml", maxAttempts: 2, expectedRequests: 2, expectedStatus: http.StatusTooManyRequests},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret", WithStrategy(RemoteOnly), WithClock(newFakeClock()),
+				WithRetryPolicy(RetryPolicy{MaxAttempts: test.maxAttempts, BaseDelay: time.Second}))
+			before := atomic.LoadInt64(&s3.objectRequests)
+
+			start := time.Now()
+			_, _, err := fetcher.Fetch(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: test.key})
+			require.Error(t, err)
+			assert.True(t, time.Since(start) < time.Second, "no real sleeps between requests: %v", time.Since(start))
+			assert.Equal(t, test.expectedRequests, atomic.LoadInt64(&s3.objectRequests)-before)
+			assert.Equal(t, test.expectedStatus, minio.ToErrorResponse(pkgerrors.Cause(err.(*FetchError).Err)).StatusCode)
+			assert.True(t, IsRetryable(err.(*FetchError).Err), "%v", err)
+		})
+	}
+}
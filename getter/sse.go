@@ -0,0 +1,94 @@
+package getter
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/minio/minio-go/pkg/encrypt"
+	"github.com/pkg/errors"
+)
+
+// KeyProvider supplies the customer provided keys remote objects are encrypted with, SSE-C in S3 terms
+type KeyProvider interface {
+	// SSECKey returns the 32 byte key of bucket/key, nil when the object is not encrypted with one.
+	// It is asked for every request made for the object, so it should be cheap.
+	SSECKey(ctx context.Context, bucket, key string) ([]byte, error)
+}
+
+// KeyProviderFunc is a function used as a KeyProvider
+type KeyProviderFunc func(ctx context.Context, bucket, key string) ([]byte, error)
+
+// SSECKey calls f
+func (f KeyProviderFunc) SSECKey(ctx context.Context, bucket, key string) ([]byte, error) {
+	return f(ctx, bucket, key)
+}
+
+// StaticKeys is a KeyProvider holding keys per bucket and per object. An object's own key is used over its
+// bucket's.
+type StaticKeys struct {
+	// Buckets holds the key of every object in a bucket, keyed by bucket name
+	Buckets map[string][]byte
+	// Objects holds the keys of single objects, keyed by "bucket/key"
+	Objects map[string][]byte
+}
+
+// SSECKey returns the key of bucket/key, or of its bucket
+func (s StaticKeys) SSECKey(ctx context.Context, bucket, key string) ([]byte, error) {
+	if k, ok := s.Objects[bucket+"/"+key]; ok {
+		return k, nil
+	}
+	return s.Buckets[bucket], nil
+}
+
+// WithSSECKeys fetches remote objects with the customer provided keys p supplies. Keys are only sent over HTTPS,
+// see WithSecure, and fetches that need one fail otherwise. Objects fetched with a key are never written to the
+// disk cache, and the keys are never logged.
+func WithSSECKeys(p KeyProvider) Option {
+	return func(g *Getter) {
+		g.sseKeys = p
+	}
+}
+
+// serverSideEncryption returns the SSE-C settings for req, nil when there is no key provider or it has no key
+// for req. A key is only ever sent over HTTPS, so it is refused unless secure is set. Errors never carry the key.
+func serverSideEncryption(ctx context.Context, keys KeyProvider, secure bool, req FetchRequest) (encrypt.ServerSide, error) {
+	if keys == nil {
+		return nil, nil
+	}
+	key, err := keys.SSECKey(ctx, req.Bucket, req.Key)
+	if err != nil {
+		return nil, requestError{errors.Wrap(err, "unable to get SSE-C key")}
+	}
+	if key == nil {
+		return nil, nil
+	}
+	if !secure {
+		return nil, requestError{errors.Errorf("refusing to send the SSE-C key of %s/%s over plain HTTP, see WithSecure", req.Bucket, req.Key)}
+	}
+	sse, err := encrypt.NewSSEC(key)
+	if err != nil {
+		return nil, requestError{errors.Errorf("invalid SSE-C key of %d bytes, it must be 32", len(key))}
+	}
+	return sse, nil
+}
+
+// serverSideEncryptionOf names how the object whose headers are header is encrypted by the remote file system,
+// using the types of minio-go/pkg/encrypt
+func serverSideEncryptionOf(header http.Header) string {
+	if header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return string(encrypt.SSEC)
+	}
+	switch header.Get("X-Amz-Server-Side-Encryption") {
+	case "aws:kms":
+		return string(encrypt.KMS)
+	case "AES256":
+		return string(encrypt.S3)
+	}
+	return ""
+}
+
+// etagIsOpaque reports whether the ETag of an object cannot be the MD5 of its content because of how it is
+// encrypted
+func etagIsOpaque(info ObjectInfo) bool {
+	return info.ServerSideEncryption == string(encrypt.SSEC) || info.ServerSideEncryption == string(encrypt.KMS)
+}
@@ -0,0 +1,133 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchSSEC verifies that objects encrypted with customer keys are fetched over HTTPS with the key of their
+// bucket or their own, that keys are never sent in the clear, and that they never show up in errors or logs
+func TestFetchSSEC(t *testing.T) {
+	bucketKey := bytes.Repeat([]byte("b"), 32)
+	objectKey := bytes.Repeat([]byte("o"), 32)
+	s3 := newFakeS3TLS(t, nil)
+	defer s3.Close()
+	s3.PutEncrypted("bucket", "mail.eml", []byte("bucket keyed"), bucketKey)
+	s3.PutEncrypted("bucket", "own.eml", []byte("object keyed"), objectKey)
+	s3.Put("bucket", "plain.eml", []byte("plain"))
+	plaintext := newFakeS3(t)
+	defer plaintext.Close()
+	plaintext.PutEncrypted("bucket", "mail.eml", []byte("bucket keyed"), bucketKey)
+	plaintext.Put("bucket", "plain.eml", []byte("plain"))
+
+	keys := StaticKeys{
+		Buckets: map[string][]byte{"bucket": bucketKey, "short": []byte("too short")},
+		Objects: map[string][]byte{"bucket/own.eml": objectKey, "bucket/plain.eml": nil},
+	}
+	for _, test := range []struct {
+		name         string
+		keys         KeyProvider
+		insecure     bool
+		bucket, key  string
+		expectedData string
+		expectedKind error
+		expectedErr  string
+	}{
+		{name: "bucket key", keys: keys, bucket: "bucket", key: "mail.eml", expectedData: "bucket keyed"},
+		{name: "object key", keys: keys, bucket: "bucket", key: "own.eml", expectedData: "object keyed"},
+		{name: "not encrypted", keys: keys, bucket: "bucket", key: "plain.eml", expectedData: "plain"},
+		{name: "no key", bucket: "bucket", key: "mail.eml", expectedErr: "400 Bad Request"},
+		{name: "wrong key", keys: StaticKeys{Buckets: map[string][]byte{"bucket": objectKey}}, bucket: "bucket", key: "mail.eml", expectedKind: ErrAccessDenied},
+		{name: "invalid key", keys: keys, bucket: "short", key: "mail.eml", expectedErr: "invalid SSE-C key of 9 bytes"},
+		{name: "provider fails", keys: KeyProviderFunc(func(ctx context.Context, bucket, key string) ([]byte, error) {
+			return nil, errors.New("vault sealed")
+		}), bucket: "bucket", key: "mail.eml", expectedErr: "unable to get SSE-C key: vault sealed"},
+		{name: "key refused over plain http", keys: keys, insecure: true, bucket: "bucket", key: "mail.eml", expectedErr: "refusing to send the SSE-C key of bucket/mail.eml over plain HTTP"},
+		{name: "not encrypted over plain http", keys: keys, insecure: true, bucket: "bucket", key: "plain.eml", expectedData: "plain"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logBuf := &bytes.Buffer{}
+			opts := []Option{WithRetryPolicy(RetryPolicy{MaxAttempts: 2}), WithClock(newFakeClock()), WithETagVerification()}
+			server := s3
+			if test.insecure {
+				server = plaintext
+			} else {
+				opts = append(opts, WithRootCAs(serverCAs(s3)))
+			}
+			if test.keys != nil {
+				opts = append(opts, WithSSECKeys(test.keys))
+			}
+			fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "key", "secret", opts...)
+			requests := atomic.LoadInt64(&plaintext.objectRequests)
+			fh, _, err := fetcher.Fetch(context.Background(), FetchRequest{Host: server.Host(), Bucket: test.bucket, Key: test.key})
+			if test.insecure && test.expectedData == "" {
+				assert.Equal(t, requests, atomic.LoadInt64(&plaintext.objectRequests), "nothing is sent in the clear")
+			}
+			if test.expectedData == "" {
+				require.Error(t, err)
+				if test.expectedKind != nil {
+					assert.True(t, errors.Is(err, test.expectedKind), "%v", err)
+				}
+				assert.Contains(t, err.Error(), test.expectedErr)
+			} else {
+				require.NoError(t, err)
+				body, err := ioutil.ReadAll(fh)
+				require.NoError(t, err, "the ETag of an encrypted object is not checked as an MD5")
+				fh.Close()
+				assert.Equal(t, test.expectedData, string(body))
+			}
+
+			for _, key := range [][]byte{bucketKey, objectKey} {
+				for _, s := range []string{string(key), base64.StdEncoding.EncodeToString(key)} {
+					assert.NotContains(t, logBuf.String(), s)
+					if err != nil {
+						assert.NotContains(t, err.Error(), s)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestFetchSSECNotCached verifies that objects encrypted with customer keys are never kept in the disk cache
+func TestFetchSSECNotCached(t *testing.T) {
+	customerKey := bytes.Repeat([]byte("k"), 32)
+	s3 := newFakeS3TLS(t, nil)
+	defer s3.Close()
+	s3.PutEncrypted("bucket", "mail.eml", []byte("secret mail"), customerKey)
+	s3.Put("bucket", "plain.eml", []byte("plain mail"))
+
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache, err := NewDiskCache(dir, 1<<20)
+	require.NoError(t, err)
+
+	fetcher := New(discardLogger(), true, "key", "secret", WithRootCAs(serverCAs(s3)), WithDiskCache(cache),
+		WithSSECKeys(StaticKeys{Objects: map[string][]byte{"bucket/mail.eml": customerKey}}))
+	for _, key := range []string{"mail.eml", "plain.eml"} {
+		fh, source, err := fetcher.Fetch(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: key})
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(fh)
+		require.NoError(t, err)
+		fh.Close()
+		assert.Equal(t, Remote, source)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "only the plain object is cached")
+	data, err := ioutil.ReadFile(dir + "/" + files[0].Name())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "plain mail")
+}
@@ -0,0 +1,47 @@
+package getter
+
+// Strategy allows us to have a type safe value choosing which sources a Getter uses, and in which order
+type Strategy string
+
+const (
+	// RemoteFirst fetches remotely when the request has a complete remote location or a URL, falling back to the
+	// local file.
+	// It is the default when New is told to use the remote file system.
+	RemoteFirst Strategy = "remote-first"
+	// LocalFirst opens the local file, falling back to fetching remotely
+	LocalFirst Strategy = "local-first"
+	// RemoteOnly only fetches remotely or from the URL and never touches the disk, so the disk cache and spooling of shared
+	// downloads are skipped as well
+	RemoteOnly Strategy = "remote-only"
+	// LocalOnly only opens the local file. It is the default when New is told not to use the remote file system.
+	LocalOnly Strategy = "local-only"
+)
+
+// WithStrategy sets which sources are used and in which order, overriding the useRemoteFS argument of New.
+// It has no effect along with WithBackends.
+func WithStrategy(s Strategy) Option {
+	return func(g *Getter) {
+		g.strategy = s
+	}
+}
+
+// defaultStrategy is the strategy matching useRemoteFS
+func defaultStrategy(useRemoteFS bool) Strategy {
+	if useRemoteFS {
+		return RemoteFirst
+	}
+	return LocalOnly
+}
+
+// chain returns the backends the strategy tries, in order. Hedged fetches race the two built in backends instead.
+func (s Strategy) chain() []string {
+	switch s {
+	case LocalFirst:
+		return []string{string(Local), string(Remote), string(HTTP)}
+	case RemoteOnly:
+		return []string{string(Remote), string(HTTP)}
+	case LocalOnly:
+		return []string{string(Local)}
+	}
+	return []string{string(Remote), string(HTTP), string(Local)}
+}
@@ -0,0 +1,118 @@
+package getter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchStrategy verifies that each strategy tries the sources it should, in the order it should
+func TestFetchStrategy(t *testing.T) {
+	full := FetchRequest{LocalPath: "localpath", Host: "host", Bucket: "bucket", Key: "key"}
+	remoteOnlyReq := FetchRequest{Host: "host", Bucket: "bucket", Key: "key"}
+	localOnlyReq := FetchRequest{LocalPath: "localpath"}
+
+	tests := []struct {
+		name           string
+		strategy       Strategy
+		req            FetchRequest
+		remoteErr      error
+		localErr       error
+		expectedSource Source
+		// expectedErr is the Source of the expected FetchError, empty for success
+		expectedErr    Source
+		invalid        bool
+		expectedRemote bool
+		expectedLocal  bool
+		expectedLog    string
+	}{
+		{name: "remote first", strategy: RemoteFirst, req: full, expectedSource: Remote, expectedRemote: true},
+		{name: "remote first fallback", strategy: RemoteFirst, req: full, remoteErr: errNoSuchKey, expectedSource: Local, expectedRemote: true, expectedLocal: true, expectedLog: "falling back to local source"},
+		{name: "local first", strategy: LocalFirst, req: full, expectedSource: Local, expectedLocal: true},
+		{name: "local first fallback", strategy: LocalFirst, req: full, localErr: os.ErrNotExist, expectedSource: Remote, expectedRemote: true, expectedLocal: true, expectedLog: "falling back to remote source"},
+		{name: "local first both fail", strategy: LocalFirst, req: full, localErr: os.ErrNotExist, remoteErr: errNoSuchKey, expectedErr: Remote, expectedRemote: true, expectedLocal: true},
+		{name: "local first without local path", strategy: LocalFirst, req: remoteOnlyReq, expectedSource: Remote, expectedRemote: true},
+		{name: "local first without remote", strategy: LocalFirst, req: localOnlyReq, localErr: os.ErrNotExist, expectedErr: Local, expectedLocal: true},
+		{name: "remote only", strategy: RemoteOnly, req: full, expectedSource: Remote, expectedRemote: true},
+		{name: "remote only fails", strategy: RemoteOnly, req: full, remoteErr: errNoSuchKey, expectedErr: Remote, expectedRemote: true},
+		{name: "remote only without remote", strategy: RemoteOnly, req: localOnlyReq, invalid: true},
+		{name: "local only", strategy: LocalOnly, req: full, expectedSource: Local, expectedLocal: true},
+		{name: "local only fails", strategy: LocalOnly, req: full, localErr: os.ErrNotExist, expectedErr: Local, expectedLocal: true},
+		{name: "sources reorder", strategy: RemoteFirst, req: withSources(full, Local, Remote), expectedSource: Local, expectedLocal: true},
+		{name: "sources narrow", strategy: LocalFirst, req: withSources(full, Remote), remoteErr: errNoSuchKey, expectedErr: Remote, expectedRemote: true},
+		{name: "local source under remote only", strategy: RemoteOnly, req: withSources(full, Local), invalid: true},
+		{name: "local fallback source under remote only", strategy: RemoteOnly, req: withSources(full, Remote, Local), invalid: true},
+		{name: "remote source under local only", strategy: LocalOnly, req: withSources(full, Remote), invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logBuf := &bytes.Buffer{}
+			// useRemoteFS is overridden by the strategy
+			fetcher := New(log.New(logBuf, "test", log.LstdFlags), false, "key", "secret", WithStrategy(test.strategy))
+			remote := &fakeRemote{data: []byte("remote data"), err: test.remoteErr}
+			local := &fakeLocal{data: []byte("local data"), err: test.localErr}
+			fetcher.remote = remote
+			fetcher.local = local
+
+			fh, source, err := fetcher.Fetch(context.Background(), test.req)
+			assert.Equal(t, test.expectedRemote, remote.fetched, "remote fetched")
+			assert.Equal(t, test.expectedLocal, local.opened, "local opened")
+			if test.expectedLog != "" {
+				assert.Contains(t, logBuf.String(), test.expectedLog)
+			}
+			if test.invalid {
+				assert.True(t, errors.Is(err, ErrInvalidRequest), "got %v", err)
+				return
+			}
+			if test.expectedErr != "" {
+				var fetchErr *FetchError
+				require.True(t, errors.As(err, &fetchErr), "got %v", err)
+				assert.Equal(t, test.expectedErr, fetchErr.Source)
+				return
+			}
+
+			require.NoError(t, err)
+			defer fh.Close()
+			assert.Equal(t, test.expectedSource, source)
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, string(test.expectedSource)+" data", string(body))
+		})
+	}
+}
+
+// withSources returns req with its Sources set to sources
+func withSources(req FetchRequest, sources ...Source) FetchRequest {
+	req.Sources = sources
+	return req
+}
+
+// TestFetchStrategyDefault verifies that useRemoteFS picks the default strategy
+func TestFetchStrategyDefault(t *testing.T) {
+	assert.Equal(t, RemoteFirst, New(discardLogger(), true, "key", "secret").strategy)
+	assert.Equal(t, LocalOnly, New(discardLogger(), false, "key", "secret").strategy)
+	assert.Equal(t, LocalFirst, New(discardLogger(), true, "key", "secret", WithStrategy(LocalFirst)).strategy)
+}
+
+// TestFetchRemoteOnlySkipsDisk verifies that the remote-only strategy does not write to the disk cache
+func TestFetchRemoteOnlySkipsDisk(t *testing.T) {
+	f := newCacheFixture(t, 1<<20)
+	defer f.Close()
+	f.s3.Put("bucket", "mail.eml", []byte("file data"))
+	f.fetcher = New(discardLogger(), true, "key", "secret", WithDiskCache(f.cache), WithStrategy(RemoteOnly))
+
+	for i := 0; i < 2; i++ {
+		body, source := f.fetch(t, "mail.eml")
+		assert.Equal(t, "file data", body)
+		assert.Equal(t, Remote, source)
+	}
+	assert.Empty(t, f.files(t))
+}
@@ -0,0 +1,140 @@
+package getter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// WithSecure makes remote fetches use HTTPS, verified against the system roots unless WithRootCAs is also given
+func WithSecure() Option {
+	return func(g *Getter) {
+		g.secure = true
+	}
+}
+
+// WithTLSConfig makes remote fetches use HTTPS configured by cfg. WithRootCAs and WithClientCertificate
+// given after it add to a copy of cfg.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(g *Getter) {
+		g.secure = true
+		g.tlsConfig = cfg.Clone()
+	}
+}
+
+// WithRootCAs makes remote fetches use HTTPS and trust only the certificate authorities in pool.
+// LoadCAFile builds a pool from a PEM bundle.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(g *Getter) {
+		g.secure = true
+		g.ensureTLSConfig().RootCAs = pool
+	}
+}
+
+// WithClientCertificate makes remote fetches use HTTPS and present cert to servers that ask for one
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(g *Getter) {
+		g.secure = true
+		cfg := g.ensureTLSConfig()
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+}
+
+// WithSignature forces remote requests to be signed with sig, overriding what the credentials ask for.
+// credentials.SignatureV2, SignatureV4 and SignatureV4Streaming are supported; streaming only changes how
+// uploads are signed, so fetches made with it are signed with V4.
+func WithSignature(sig credentials.SignatureType) Option {
+	return func(g *Getter) {
+		g.signature = sig
+	}
+}
+
+// LoadCAFile reads a PEM encoded certificate authority bundle from path for use with WithRootCAs
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read CA file")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no PEM certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// ensureTLSConfig returns the Getter's TLS config, creating an empty one first if needed
+func (g *Getter) ensureTLSConfig() *tls.Config {
+	if g.tlsConfig == nil {
+		g.tlsConfig = &tls.Config{}
+	}
+	return g.tlsConfig
+}
+
+// newMinioClient creates a client for host that signs with creds and uses the Getter's transport settings
+func (g *Getter) newMinioClient(host string, creds *credentials.Credentials) (*minio.Client, error) {
+	if g.signature != credentials.SignatureDefault {
+		creds = credentials.New(&signerProvider{creds: creds, signature: g.signature})
+	}
+
+	client, err := minio.NewWithCredentials(host, creds, g.secure, "")
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = minio.DefaultTransport
+	if g.transport != nil {
+		transport = g.transport
+	}
+	client.SetCustomTransport(singleAttemptTransport{RoundTripper: transport})
+	return client, nil
+}
+
+// newTransport returns a transport matching minio.DefaultTransport that uses cfg for TLS, the system
+// defaults when cfg is nil
+func newTransport(cfg *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       cfg,
+		// objects stored with a gzip content-encoding must reach the caller untouched
+		DisableCompression: true,
+	}
+}
+
+// signerProvider hands out the values of creds with the signature type replaced
+type signerProvider struct {
+	creds     *credentials.Credentials
+	signature credentials.SignatureType
+}
+
+// Retrieve returns the current value of the wrapped credentials, signed with the forced signature type
+func (p *signerProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.creds.Get()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if !value.SignerType.IsAnonymous() {
+		value.SignerType = p.signature
+	}
+	return value, nil
+}
+
+// IsExpired reports whether the wrapped credentials need a refresh
+func (p *signerProvider) IsExpired() bool {
+	return p.creds.IsExpired()
+}
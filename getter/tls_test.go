@@ -0,0 +1,182 @@
+package getter
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serverCAs returns a pool trusting the certificate of a TLS fakeS3
+func serverCAs(s3 *fakeS3) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s3.Certificate())
+	return pool
+}
+
+// selfSignedCert makes a throwaway client certificate
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mail-worker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestFetchTLS verifies that HTTPS fetches only succeed when the server can be trusted and, if it asks, we can identify ourselves
+func TestFetchTLS(t *testing.T) {
+	clientCert := selfSignedCert(t)
+
+	for _, test := range []struct {
+		name string
+		// the TLS config of the fake object store
+		serverTLS *tls.Config
+		// builds the Getter options from the running server
+		opts           func(s3 *fakeS3) []Option
+		expectedSource Source
+		expectedLogs   []string
+	}{
+		{
+			name:           "trusted CA",
+			opts:           func(s3 *fakeS3) []Option { return []Option{WithRootCAs(serverCAs(s3))} },
+			expectedSource: Remote,
+		},
+		{
+			name:           "unknown CA falls back to local",
+			opts:           func(s3 *fakeS3) []Option { return []Option{WithSecure()} },
+			expectedSource: Local,
+			expectedLogs:   []string{"falling back to local source", "certificate"},
+		},
+		{
+			name:           "plaintext against TLS server falls back to local",
+			opts:           func(s3 *fakeS3) []Option { return nil },
+			expectedSource: Local,
+			expectedLogs:   []string{"falling back to local source"},
+		},
+		{
+			name:      "client certificate presented",
+			serverTLS: &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+			opts: func(s3 *fakeS3) []Option {
+				return []Option{WithRootCAs(serverCAs(s3)), WithClientCertificate(clientCert)}
+			},
+			expectedSource: Remote,
+		},
+		{
+			name:      "client certificate missing",
+			serverTLS: &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+			opts: func(s3 *fakeS3) []Option {
+				return []Option{WithTLSConfig(&tls.Config{RootCAs: serverCAs(s3)})}
+			},
+			expectedSource: Local,
+			expectedLogs:   []string{"falling back to local source"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newFakeS3TLS(t, test.serverTLS)
+			defer s3.Close()
+			// keep the server from logging handshake failures into the test output
+			s3.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+			s3.Put("bucket", "key", []byte("remote data"))
+
+			logBuf := &bytes.Buffer{}
+			fetcher := New(log.New(logBuf, "test", log.LstdFlags), true, "key", "secret", test.opts(s3)...)
+			fetcher.local = &fakeLocal{data: []byte("local data")}
+
+			fh, source, err := fetcher.FetchFile("localpath", s3.Host(), "bucket", "key")
+			require.NoError(t, err)
+			defer fh.Close()
+			assert.Equal(t, test.expectedSource, source)
+			for _, expected := range test.expectedLogs {
+				assert.Contains(t, logBuf.String(), expected)
+			}
+		})
+	}
+}
+
+// TestLoadCAFile verifies that CA bundles are read from PEM files
+func TestLoadCAFile(t *testing.T) {
+	s3 := newFakeS3TLS(t, nil)
+	defer s3.Close()
+	s3.Put("bucket", "key", []byte("remote data"))
+
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s3.Certificate().Raw}), 0600))
+	garbage := filepath.Join(dir, "garbage.pem")
+	require.NoError(t, ioutil.WriteFile(garbage, []byte("not a certificate"), 0600))
+
+	pool, err := LoadCAFile(bundle)
+	require.NoError(t, err)
+	fetcher := New(discardLogger(), true, "key", "secret", WithRootCAs(pool))
+	fh, source, err := fetcher.FetchFile("", s3.Host(), "bucket", "key")
+	require.NoError(t, err)
+	fh.Close()
+	assert.Equal(t, Remote, source)
+
+	_, err = LoadCAFile(garbage)
+	assert.Error(t, err)
+	_, err = LoadCAFile(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
+
+// TestFetchSignature verifies that the configured signature version is used to sign requests
+func TestFetchSignature(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		opts           []Option
+		expectedScheme string
+	}{
+		{name: "default keeps V2 for static keys", expectedScheme: "AWS "},
+		{name: "V2", opts: []Option{WithSignature(credentials.SignatureV2)}, expectedScheme: "AWS "},
+		{name: "V4", opts: []Option{WithSignature(credentials.SignatureV4)}, expectedScheme: "AWS4-HMAC-SHA256 "},
+		{name: "V4 streaming", opts: []Option{WithSignature(credentials.SignatureV4Streaming)}, expectedScheme: "AWS4-HMAC-SHA256 "},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s3 := newFakeS3TLS(t, nil)
+			defer s3.Close()
+			s3.Put("bucket", "key", []byte("remote data"))
+
+			opts := append([]Option{WithRootCAs(serverCAs(s3))}, test.opts...)
+			fetcher := New(discardLogger(), true, "key", "secret", opts...)
+			fh, source, err := fetcher.FetchFile("", s3.Host(), "bucket", "key")
+			require.NoError(t, err)
+			fh.Close()
+			assert.Equal(t, Remote, source)
+
+			s3.mu.Lock()
+			defer s3.mu.Unlock()
+			require.NotEmpty(t, s3.authHeaders)
+			for _, auth := range s3.authHeaders {
+				assert.True(t, strings.HasPrefix(auth, test.expectedScheme), "unexpected Authorization header %q", auth)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package getter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// uriFallbackSeparator separates a primary URI from its fallback
+const uriFallbackSeparator = "|"
+
+// ErrInvalidURI is reported for URIs that ParseURI cannot turn into a FetchRequest
+var ErrInvalidURI = errors.New("invalid uri")
+
+// URIError describes a URI that could not be parsed. It matches ErrInvalidURI with errors.Is.
+type URIError struct {
+	// URI is the URI that was parsed, redacted of any query and user info
+	URI string
+	// Reason says what is wrong with it
+	Reason string
+}
+
+// Error describes what is wrong with the URI
+func (e *URIError) Error() string {
+	return fmt.Sprintf("%v %q: %s", ErrInvalidURI, e.URI, e.Reason)
+}
+
+// Is reports whether target is ErrInvalidURI
+func (e *URIError) Is(target error) bool {
+	return target == ErrInvalidURI
+}
+
+// ParseURI turns uri into the FetchRequest it names. The forms understood are
+//
+//	s3://host[:port]/bucket/key
+//	file:///absolute/path
+//	http://... and https://...
+//
+// A fragment names a member of a tar or zip archive, as in s3://host/bucket/bundle.tar.gz#path/in/archive.
+// A fallback can follow the primary URI after a "|", as in "s3://host/bucket/key | file:///var/mail/x.eml".
+// The two must name different kinds of location, and the request's Sources try them in the order given.
+// Errors are a *URIError.
+func ParseURI(uri string) (FetchRequest, error) {
+	parts := strings.Split(uri, uriFallbackSeparator)
+	if len(parts) > 2 {
+		return FetchRequest{}, &URIError{URI: redactURI(uri), Reason: "only one fallback may follow the primary uri"}
+	}
+
+	var req FetchRequest
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		source, err := parseURIPart(part, &req)
+		if err != nil {
+			return FetchRequest{}, &URIError{URI: redactURI(part), Reason: err.Error()}
+		}
+		for _, s := range req.Sources {
+			if s == source {
+				return FetchRequest{}, &URIError{URI: redactURI(uri), Reason: fmt.Sprintf("the primary and fallback are both %s locations", source)}
+			}
+		}
+		req.Sources = append(req.Sources, source)
+	}
+
+	if err := req.validate(); err != nil {
+		return FetchRequest{}, &URIError{URI: redactURI(uri), Reason: err.Error()}
+	}
+	return req, nil
+}
+
+// parseURIPart fills in the part of req named by uri, returning the source that serves it
+func parseURIPart(uri string, req *FetchRequest) (Source, error) {
+	if uri == "" {
+		return "", errors.New("empty uri")
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.New("cannot be parsed")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if err := validateURL(uri); err != nil {
+			return "", err
+		}
+		req.URL = uri
+		return HTTP, nil
+	case "s3", "file":
+	case "":
+		return "", errors.New("missing scheme, expected s3, file, http or https")
+	default:
+		return "", errors.Errorf("unsupported scheme %q, expected s3, file, http or https", u.Scheme)
+	}
+
+	if u.User != nil {
+		return "", errors.New("user info is not supported, see WithCredentials")
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		return "", errors.New("queries are not supported")
+	}
+	if u.Opaque != "" {
+		return "", errors.Errorf("%s uris must start with %s://", u.Scheme, u.Scheme)
+	}
+
+	if u.Scheme == "file" {
+		if u.Host != "" && u.Host != "localhost" {
+			return "", errors.Errorf("file host %q is not supported, only local files can be named", u.Host)
+		}
+		if u.Path == "" {
+			return "", errors.New("missing path")
+		}
+		if err := checkArchiveFragment(u); err != nil {
+			return "", err
+		}
+		req.LocalPath = filepath.FromSlash(u.Path) + fragmentMember(u)
+		return Local, nil
+	}
+
+	if u.Host == "" {
+		return "", errors.New("missing host")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return "", errors.New("missing bucket")
+	}
+	if len(parts) < 2 || parts[1] == "" {
+		return "", errors.New("missing key")
+	}
+	if err := checkArchiveFragment(u); err != nil {
+		return "", err
+	}
+	req.Host, req.Bucket, req.Key = u.Host, parts[0], parts[1]+fragmentMember(u)
+	// a uri names exactly one location per part, so a malformed one is never left for a later part to cover
+	if err := req.remoteErr(); err != nil {
+		return "", err
+	}
+	return Remote, nil
+}
+
+// checkArchiveFragment reports an error if u has a fragment but is not an archive whose member it can name
+func checkArchiveFragment(u *url.URL) error {
+	if u.Fragment == "" {
+		return nil
+	}
+	if _, _, ok := archiveFormatOf(u.Path); !ok {
+		return errors.New("fragments name archive members, but the path is not a tar or zip archive")
+	}
+	return nil
+}
+
+// fragmentMember returns the archive member named by the fragment of u, ready to append to a location
+func fragmentMember(u *url.URL) string {
+	if u.Fragment == "" {
+		return ""
+	}
+	return archiveMemberSeparator + u.Fragment
+}
+
+// redactURI strips the parts of uri that may hold credentials, even when it cannot be parsed
+func redactURI(uri string) string {
+	if _, err := url.Parse(uri); err == nil {
+		return redactURL(uri)
+	}
+	uri = strings.SplitN(uri, "?", 2)[0]
+	if i := strings.Index(uri, "@"); i >= 0 {
+		if j := strings.Index(uri, "://"); j >= 0 && j < i {
+			uri = uri[:j+3] + uri[i+1:]
+		}
+	}
+	return uri
+}
+
+// FetchURI is Fetch for the request ParseURI makes of uri. A URI that cannot be parsed is reported as a
+// *FetchError matching both ErrInvalidRequest and ErrInvalidURI, one naming a kind of location the Getter does
+// not use as a *FetchError matching ErrInvalidRequest.
+func (g *Getter) FetchURI(ctx context.Context, uri string) (io.ReadCloser, Source, error) {
+	req, err := ParseURI(uri)
+	if err != nil {
+		return nil, "", invalidRequestError(req, err)
+	}
+	return g.Fetch(ctx, req)
+}
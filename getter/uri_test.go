@@ -0,0 +1,134 @@
+package getter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseURI verifies that each kind of URI, alone or with a fallback, becomes the matching request
+func TestParseURI(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		uri         string
+		expected    FetchRequest
+		expectedErr string
+	}{
+		{name: "s3", uri: "s3://s3.example.com/bucket/dir/mail.eml", expected: FetchRequest{Host: "s3.example.com", Bucket: "bucket", Key: "dir/mail.eml", Sources: []Source{Remote}}},
+		{name: "s3 with port", uri: "s3://localhost:9000/bucket/mail.eml", expected: FetchRequest{Host: "localhost:9000", Bucket: "bucket", Key: "mail.eml", Sources: []Source{Remote}}},
+		{name: "s3 escaped key", uri: "s3://host/bucket/mail%20one.eml", expected: FetchRequest{Host: "host", Bucket: "bucket", Key: "mail one.eml", Sources: []Source{Remote}}},
+		{name: "file", uri: "file:///var/mail/x.eml", expected: FetchRequest{LocalPath: filepath.FromSlash("/var/mail/x.eml"), Sources: []Source{Local}}},
+		{name: "file on localhost", uri: "file://localhost/var/mail/x.eml", expected: FetchRequest{LocalPath: filepath.FromSlash("/var/mail/x.eml"), Sources: []Source{Local}}},
+		{name: "https", uri: "https://example.com/x.eml?sig=abc", expected: FetchRequest{URL: "https://example.com/x.eml?sig=abc", Sources: []Source{HTTP}}},
+		{name: "archive member", uri: "s3://host/bucket/bundle.tar.gz#day/x.eml", expected: FetchRequest{Host: "host", Bucket: "bucket", Key: "bundle.tar.gz#day/x.eml", Sources: []Source{Remote}}},
+		{name: "local archive member", uri: "file:///var/mail/bundle.zip#x.eml", expected: FetchRequest{LocalPath: filepath.FromSlash("/var/mail/bundle.zip") + "#x.eml", Sources: []Source{Local}}},
+		{name: "fallback", uri: "s3://host/bucket/key | file:///var/mail/x.eml", expected: FetchRequest{LocalPath: filepath.FromSlash("/var/mail/x.eml"), Host: "host", Bucket: "bucket", Key: "key", Sources: []Source{Remote, Local}}},
+		{name: "local primary", uri: "file:///var/mail/x.eml|https://example.com/x.eml", expected: FetchRequest{LocalPath: filepath.FromSlash("/var/mail/x.eml"), URL: "https://example.com/x.eml", Sources: []Source{Local, HTTP}}},
+
+		{name: "empty", uri: "", expectedErr: "empty uri"},
+		{name: "empty fallback", uri: "s3://host/bucket/key |", expectedErr: "empty uri"},
+		{name: "two fallbacks", uri: "s3://host/bucket/key | file:///a | https://example.com/a", expectedErr: "only one fallback"},
+		{name: "same kind twice", uri: "file:///a | file:///b", expectedErr: "both local locations"},
+		{name: "no scheme", uri: "/var/mail/x.eml", expectedErr: "missing scheme"},
+		{name: "unknown scheme", uri: "ftp://host/x.eml", expectedErr: `unsupported scheme "ftp"`},
+		{name: "s3 without host", uri: "s3:///bucket/key", expectedErr: "missing host"},
+		{name: "s3 without bucket", uri: "s3://host/", expectedErr: "missing bucket"},
+		{name: "s3 without key", uri: "s3://host/bucket/", expectedErr: "missing key"},
+		{name: "s3 bad bucket", uri: "s3://host/B_/key", expectedErr: `invalid bucket "B_"`},
+		{name: "s3 bad bucket with fallback", uri: "s3://host/B_/key | file:///var/mail/x.eml", expectedErr: `invalid bucket "B_"`},
+		{name: "s3 credentials", uri: "s3://AKID:secret@host/bucket/key", expectedErr: "user info is not supported"},
+		{name: "s3 query", uri: "s3://host/bucket/key?versionId=1", expectedErr: "queries are not supported"},
+		{name: "s3 opaque", uri: "s3:host/bucket/key", expectedErr: "must start with s3://"},
+		{name: "file on another host", uri: "file://mailhost/var/mail/x.eml", expectedErr: `file host "mailhost"`},
+		{name: "file without path", uri: "file://", expectedErr: "missing path"},
+		{name: "file fragment", uri: "file:///var/mail/x.eml#part", expectedErr: "not a tar or zip archive"},
+		{name: "http without host", uri: "http:///x.eml", expectedErr: "has no host"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := ParseURI(test.uri)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, ErrInvalidURI))
+				assert.Contains(t, err.Error(), test.expectedErr)
+				assert.NotContains(t, err.Error(), "secret")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, req)
+		})
+	}
+}
+
+// TestFetchURI verifies that the primary URI is tried first, falling back to the second, and that URIs
+// which cannot be parsed are invalid requests
+func TestFetchURI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	localPath := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(localPath, []byte("local data"), 0600))
+	localURI := "file://" + filepath.ToSlash(localPath)
+
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "mail.eml", []byte("remote data"))
+
+	for _, test := range []struct {
+		name           string
+		uri            string
+		expectedData   string
+		expectedSource Source
+	}{
+		{name: "remote", uri: "s3://" + s3.Host() + "/bucket/mail.eml", expectedData: "remote data", expectedSource: Remote},
+		{name: "remote primary", uri: "s3://" + s3.Host() + "/bucket/mail.eml | " + localURI, expectedData: "remote data", expectedSource: Remote},
+		{name: "local primary", uri: localURI + " | s3://" + s3.Host() + "/bucket/mail.eml", expectedData: "local data", expectedSource: Local},
+		{name: "remote falls back", uri: "s3://" + s3.Host() + "/bucket/missing.eml | " + localURI, expectedData: "local data", expectedSource: Local},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// local first, so trying remote first must come from the uri
+			fetcher := New(discardLogger(), false, "key", "secret", WithStrategy(LocalFirst))
+			fh, source, err := fetcher.FetchURI(context.Background(), test.uri)
+			require.NoError(t, err)
+			defer fh.Close()
+			body, err := ioutil.ReadAll(fh)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedData, string(body))
+			assert.Equal(t, test.expectedSource, source)
+		})
+	}
+
+	// the uri cannot reach past the sources the strategy allows
+	for _, test := range []struct {
+		name     string
+		strategy Strategy
+		uri      string
+	}{
+		{name: "file under remote only", strategy: RemoteOnly, uri: localURI},
+		{name: "file fallback under remote only", strategy: RemoteOnly, uri: "s3://" + s3.Host() + "/bucket/missing.eml | " + localURI},
+		{name: "s3 under local only", strategy: LocalOnly, uri: "s3://" + s3.Host() + "/bucket/mail.eml"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), true, "key", "secret", WithStrategy(test.strategy))
+			_, _, err := fetcher.FetchURI(context.Background(), test.uri)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrInvalidRequest))
+			assert.False(t, errors.Is(err, ErrInvalidURI))
+			assert.Contains(t, err.Error(), "is not one of the sources the getter uses")
+		})
+	}
+
+	fetcher := New(discardLogger(), true, "key", "secret")
+	_, _, err = fetcher.FetchURI(context.Background(), "s3://host/bucket")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInvalidRequest))
+	assert.True(t, errors.Is(err, ErrInvalidURI))
+	var uriErr *URIError
+	require.True(t, errors.As(err, &uriErr))
+	assert.Equal(t, "s3://host/bucket", uriErr.URI)
+}
@@ -0,0 +1,148 @@
+package getter
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumAlgorithm allows us to have a type safe value naming how a checksum was computed
+type ChecksumAlgorithm string
+
+const (
+	// ChecksumMD5 is the MD5 of the content, the same as the ETag of most remote files
+	ChecksumMD5 ChecksumAlgorithm = "md5"
+	// ChecksumSHA256 is the SHA-256 of the content
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	// ChecksumCRC32C is the CRC-32 of the content using the Castagnoli polynomial
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// ErrChecksumMismatch is reported at the end of a file whose content does not hash to what was expected
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksum is the expected hash of a file's content
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	// Value is the hex encoded hash
+	Value string
+}
+
+// ChecksumError describes content that did not match its checksum. It matches ErrChecksumMismatch with errors.Is.
+type ChecksumError struct {
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+// Error describes the mismatch
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%v: expected %s %s, got %s", ErrChecksumMismatch, e.Algorithm, e.Expected, e.Actual)
+}
+
+// Is reports whether target is ErrChecksumMismatch
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// WithETagVerification checks remote files against their ETag while they are read, when the ETag is a plain
+// MD5 of the content. Multipart and other opaque ETags are not checked.
+func WithETagVerification() Option {
+	return func(g *Getter) {
+		g.verifyETag = true
+	}
+}
+
+// newHash returns a hash for the algorithm
+func (a ChecksumAlgorithm) newHash() (hash.Hash, error) {
+	switch a {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, errors.Errorf("unknown checksum algorithm %q", a)
+}
+
+// validate reports whether the checksum can be checked
+func (c Checksum) validate() error {
+	h, err := c.Algorithm.newHash()
+	if err != nil {
+		return err
+	}
+	sum, err := hex.DecodeString(c.Value)
+	if err != nil || len(sum) != h.Size() {
+		return errors.Errorf("%s checksum %q must be %d hex encoded bytes", c.Algorithm, c.Value, h.Size())
+	}
+	return nil
+}
+
+// etagChecksum returns the checksum an ETag stands for, or nil if it is not a plain MD5
+func etagChecksum(etag string) *Checksum {
+	c := Checksum{Algorithm: ChecksumMD5, Value: strings.ToLower(strings.Trim(etag, `"`))}
+	if c.validate() != nil {
+		return nil
+	}
+	return &c
+}
+
+// verify wraps the body of res so it is checked against the request's checksum, or against the ETag when
+// that is enabled. Partial reads cannot be checked and are returned as is.
+func (g *Getter) verify(req FetchRequest, res *FetchResult) {
+	if req.Range != nil {
+		return
+	}
+
+	expected := req.Checksum
+	if expected == nil && g.verifyETag && (res.Source == Remote || res.Source == Cached) && !etagIsOpaque(res.ObjectInfo) {
+		expected = etagChecksum(res.ETag)
+	}
+	if expected == nil {
+		return
+	}
+
+	h, _ := expected.Algorithm.newHash()
+	res.Body = &verifyingReader{rc: res.Body, hash: h, expected: *expected}
+}
+
+// verifyingReader hashes content as it is read and reports a ChecksumError at the end if it does not match
+type verifyingReader struct {
+	rc       io.ReadCloser
+	hash     hash.Hash
+	expected Checksum
+	err      error
+}
+
+// Read reads from the underlying reader, checking the checksum once it reaches the end
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.rc.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		actual := hex.EncodeToString(r.hash.Sum(nil))
+		if !strings.EqualFold(actual, r.expected.Value) {
+			err = &ChecksumError{Algorithm: r.expected.Algorithm, Expected: strings.ToLower(r.expected.Value), Actual: actual}
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Close closes the underlying reader
+func (r *verifyingReader) Close() error {
+	return r.rc.Close()
+}
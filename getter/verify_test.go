@@ -0,0 +1,149 @@
+package getter
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchChecksum verifies that caller checksums are checked for both sources, reporting mismatches at the end
+// of the file
+func TestFetchChecksum(t *testing.T) {
+	data := []byte("Subject: hello\r\n\r\nbody")
+	md5Sum := md5.Sum(data)
+	sha := sha256.Sum256(data)
+	crc := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	crcHex := hex.EncodeToString([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)})
+	wrongSHA := strings.Repeat("0", 64)
+
+	dir, err := ioutil.TempDir("", "getter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mail.eml")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "mail.eml", data)
+
+	tests := []struct {
+		name     string
+		remote   bool
+		checksum Checksum
+		mismatch bool
+	}{
+		{name: "local md5", checksum: Checksum{Algorithm: ChecksumMD5, Value: hex.EncodeToString(md5Sum[:])}},
+		{name: "local sha256", checksum: Checksum{Algorithm: ChecksumSHA256, Value: hex.EncodeToString(sha[:])}},
+		{name: "local crc32c", checksum: Checksum{Algorithm: ChecksumCRC32C, Value: crcHex}},
+		{name: "upper case hex", checksum: Checksum{Algorithm: ChecksumMD5, Value: strings.ToUpper(hex.EncodeToString(md5Sum[:]))}},
+		{name: "local mismatch", checksum: Checksum{Algorithm: ChecksumSHA256, Value: wrongSHA}, mismatch: true},
+		{name: "remote sha256", remote: true, checksum: Checksum{Algorithm: ChecksumSHA256, Value: hex.EncodeToString(sha[:])}},
+		{name: "remote mismatch", remote: true, checksum: Checksum{Algorithm: ChecksumSHA256, Value: wrongSHA}, mismatch: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := New(discardLogger(), test.remote, "key", "secret")
+			checksum := test.checksum
+			req := FetchRequest{LocalPath: path, Host: s3.Host(), Bucket: "bucket", Key: "mail.eml", Checksum: &checksum}
+			fh, _, err := fetcher.Fetch(context.Background(), req)
+			require.NoError(t, err)
+			defer fh.Close()
+
+			body, err := ioutil.ReadAll(fh)
+			assert.Equal(t, data, body, "the content is handed over even when it does not match")
+			if !test.mismatch {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrChecksumMismatch))
+			var checksumErr *ChecksumError
+			require.True(t, errors.As(err, &checksumErr))
+			assert.Equal(t, wrongSHA, checksumErr.Expected)
+			assert.Equal(t, hex.EncodeToString(sha[:]), checksumErr.Actual)
+
+			_, err = fh.Read(make([]byte, 1))
+			assert.True(t, errors.Is(err, ErrChecksumMismatch), "the mismatch is reported on every later read")
+		})
+	}
+}
+
+// TestFetchChecksumInvalid verifies that checksums that cannot be checked are rejected up front
+func TestFetchChecksumInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  FetchRequest
+	}{
+		{name: "unknown algorithm", req: FetchRequest{LocalPath: "mail.eml", Checksum: &Checksum{Algorithm: "sha1", Value: strings.Repeat("0", 40)}}},
+		{name: "not hex", req: FetchRequest{LocalPath: "mail.eml", Checksum: &Checksum{Algorithm: ChecksumMD5, Value: strings.Repeat("z", 32)}}},
+		{name: "wrong length", req: FetchRequest{LocalPath: "mail.eml", Checksum: &Checksum{Algorithm: ChecksumCRC32C, Value: "00"}}},
+		{name: "range", req: FetchRequest{LocalPath: "mail.eml", Range: &ByteRange{Length: 4}, Checksum: &Checksum{Algorithm: ChecksumCRC32C, Value: "00000000"}}},
+	}
+
+	fetcher := New(discardLogger(), false, "key", "secret")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := fetcher.Fetch(context.Background(), test.req)
+			assert.True(t, errors.Is(err, ErrInvalidRequest), "got %v", err)
+		})
+	}
+
+	_, _, err := fetcher.FetchSeekable(context.Background(), FetchRequest{LocalPath: "mail.eml", Checksum: &Checksum{Algorithm: ChecksumCRC32C, Value: "00000000"}})
+	assert.True(t, errors.Is(err, ErrInvalidRequest), "got %v", err)
+}
+
+// TestFetchETagVerification verifies that remote files are checked against plain MD5 ETags only when asked to
+func TestFetchETagVerification(t *testing.T) {
+	data := []byte("Subject: hello\r\n\r\nbody")
+	s3 := newFakeS3(t)
+	defer s3.Close()
+	s3.Put("bucket", "good.eml", data)
+	s3.PutWithHeader("bucket", "corrupt.eml", data, http.Header{"Etag": []string{`"` + strings.Repeat("0", 32) + `"`}})
+	s3.PutWithHeader("bucket", "multipart.eml", data, http.Header{"Etag": []string{`"` + strings.Repeat("0", 32) + `-2"`}})
+
+	tests := []struct {
+		name     string
+		key      string
+		verify   bool
+		rng      *ByteRange
+		mismatch bool
+	}{
+		{name: "matching etag", key: "good.eml", verify: true},
+		{name: "corrupt", key: "corrupt.eml", verify: true, mismatch: true},
+		{name: "corrupt without verification", key: "corrupt.eml"},
+		{name: "multipart etag is not checked", key: "multipart.eml", verify: true},
+		{name: "ranges are not checked", key: "corrupt.eml", verify: true, rng: &ByteRange{Offset: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var opts []Option
+			if test.verify {
+				opts = append(opts, WithETagVerification())
+			}
+			fetcher := New(discardLogger(), true, "key", "secret", opts...)
+			fh, _, err := fetcher.Fetch(context.Background(), FetchRequest{Host: s3.Host(), Bucket: "bucket", Key: test.key, Range: test.rng})
+			require.NoError(t, err)
+			defer fh.Close()
+
+			_, err = ioutil.ReadAll(fh)
+			if test.mismatch {
+				assert.True(t, errors.Is(err, ErrChecksumMismatch), "got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}